@@ -46,6 +46,12 @@ func parseCredentials(filePath, authType string, in inputs.Handler) error {
 		// Split the line based on the first comma and then add it to the cred array
 		splitData := strings.SplitN(fileScanner.Text(), ",", 2)
 
+		// Some protocols only take a password (like vnc), so if there's no comma
+		// the whole line is the password and we don't have an account.
+		if len(splitData) == 1 {
+			splitData = []string{"", splitData[0]}
+		}
+
 		// Add the data to our input handler
 		in.AddCred(scanners.Credential{
 			Type:     authType,
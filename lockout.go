@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emperorcow/go-netscan/scanners"
+	"github.com/emperorcow/go-netscan/scanners/ldap"
+)
+
+// Keeps track of how many bad passwords each domain account has against it and stops
+// us from trying one that would take it to the lockout threshold.  We start from what
+// the DC says the account already has and add every attempt we make, dropping them
+// once they're older than the policy's observation window.
+type lockoutGuard struct {
+	reader   *ldap.PolicyReader
+	lookup   func(name string) (*ldap.AccountStatus, error) // Asks the DC about an account
+	margin   int                                            // How many attempts to leave unused below the threshold
+	mutex    sync.Mutex
+	accounts map[string]*accountAttempts
+}
+
+// What we know about one account.  The lookup only happens once, and other routines
+// wanting the same account wait on it while everyone else carries on.
+type accountAttempts struct {
+	once     sync.Once
+	status   *ldap.AccountStatus
+	err      error       // Why we couldn't read the account, if we couldn't
+	attempts []time.Time // When we tried a password against it
+}
+
+// Reads the lockout policy from the DC and sets up a guard that uses it
+func newLockoutGuard(scanner *ldap.Scanner, dc string, cred scanners.Credential, margin int) (*lockoutGuard, error) {
+	reader, err := scanner.NewPolicyReader(dc, cred)
+	if err != nil {
+		return nil, err
+	}
+	return &lockoutGuard{
+		reader:   reader,
+		lookup:   reader.Account,
+		margin:   margin,
+		accounts: map[string]*accountAttempts{},
+	}, nil
+}
+
+// Prints out the policies we found so the user knows what we're working with
+func (this *lockoutGuard) describe() {
+	fmt.Println(this.reader.Domain.String())
+	for _, policy := range this.reader.Policies {
+		fmt.Println(policy.String())
+	}
+}
+
+// Checks if we can try a credential without risking a lockout.  If we can, the attempt
+// is counted right away so other routines see it.  If we can't, we return why.
+func (this *lockoutGuard) Allow(cred scanners.Credential) (bool, string) {
+	name := accountName(cred.Account)
+	if name == "" {
+		return true, ""
+	}
+
+	// Asking the DC is slow, so we don't hold the lock for it
+	this.mutex.Lock()
+	account, ok := this.accounts[name]
+	if !ok {
+		account = &accountAttempts{}
+		this.accounts[name] = account
+	}
+	this.mutex.Unlock()
+
+	account.once.Do(func() {
+		account.status, account.err = this.lookup(name)
+		if account.err != nil {
+			// Better to skip the account than guess, but say so since the skipped
+			// attempts otherwise only show up as failures
+			fmt.Fprintf(os.Stderr, "WARNING: Skipping %s, couldn't read its lockout status: %s\n", name, account.err.Error())
+		}
+	})
+	if account.err != nil {
+		return false, "Skipped, couldn't read the account's lockout status: " + account.err.Error()
+	}
+
+	// Counting and taking an attempt has to happen together so two routines can't
+	// both take the last one
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if account.status.Locked {
+		return false, "Skipped, account is locked out"
+	}
+
+	policy := account.status.Policy
+	if policy.Threshold == 0 {
+		return true, ""
+	}
+
+	// Only the attempts inside the observation window count
+	now := time.Now()
+	recent := []time.Time{}
+	for _, attempt := range account.attempts {
+		if now.Sub(attempt) < policy.ObservationWindow {
+			recent = append(recent, attempt)
+		}
+	}
+	account.attempts = recent
+
+	count := len(recent) + account.status.RecentBadPasswords()
+
+	limit := policy.Threshold - this.margin
+	if count >= limit {
+		return false, fmt.Sprintf("Skipped to avoid lockout, %d of %d bad passwords used (%s)", count, policy.Threshold, policy.Name)
+	}
+
+	account.attempts = append(account.attempts, now)
+	return true, ""
+}
+
+// Takes a result for an attempt we allowed.  A good password resets the account's
+// bad password count on the DC, so we start counting again from zero.
+func (this *lockoutGuard) Record(result scanners.Result) {
+	if !result.Status {
+		return
+	}
+	name := accountName(result.Auth.Account)
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if account, ok := this.accounts[name]; ok && account.status != nil {
+		account.attempts = nil
+		account.status.BadPwdCount = 0
+	}
+}
+
+// Turns DOMAIN\USER or USER@DOMAIN into the sAMAccountName we look up, lower case so
+// every way of writing it counts against the same account.
+func accountName(account string) string {
+	if i := strings.LastIndex(account, "\\"); i >= 0 {
+		account = account[i+1:]
+	}
+	if i := strings.Index(account, "@"); i >= 0 {
+		account = account[:i]
+	}
+	return strings.ToLower(account)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emperorcow/go-netscan/scanners"
+	"github.com/emperorcow/go-netscan/scanners/ldap"
+)
+
+// A guard that looks accounts up with the function we give it instead of a DC
+func testGuard(margin int, lookup func(name string) (*ldap.AccountStatus, error)) *lockoutGuard {
+	return &lockoutGuard{
+		lookup:   lookup,
+		margin:   margin,
+		accounts: map[string]*accountAttempts{},
+	}
+}
+
+// A policy locking accounts after five bad passwords in half an hour
+var testPolicy = &ldap.LockoutPolicy{Name: "Test policy", Threshold: 5, ObservationWindow: 30 * time.Minute, Duration: time.Hour}
+
+func cred(account string) scanners.Credential {
+	return scanners.Credential{Account: account, AuthData: "pass", Type: "basic"}
+}
+
+func TestGuardCounts(t *testing.T) {
+	// Two recent bad passwords already, with a margin of one that leaves us two
+	guard := testGuard(1, func(name string) (*ldap.AccountStatus, error) {
+		return &ldap.AccountStatus{Found: true, BadPwdCount: 2, BadPasswordTime: time.Now(), Policy: testPolicy}, nil
+	})
+
+	for i, want := range []bool{true, true, false, false} {
+		if ok, reason := guard.Allow(cred("CORP\\alice")); ok != want {
+			t.Errorf("attempt %d: got %v (%s), want %v", i+1, ok, reason, want)
+		}
+	}
+
+	// Every way of writing the account is the same account
+	if ok, _ := guard.Allow(cred("Alice@corp.local")); ok {
+		t.Error("alice@corp.local was counted separately from CORP\\alice")
+	}
+
+	// A good password starts the count again
+	guard.Record(scanners.Result{Auth: cred("alice"), Status: true})
+	if ok, reason := guard.Allow(cred("alice")); !ok {
+		t.Errorf("not allowed after a good password: %s", reason)
+	}
+}
+
+func TestGuardOldBadPasswords(t *testing.T) {
+	// Bad passwords from outside the window don't count any more
+	guard := testGuard(0, func(name string) (*ldap.AccountStatus, error) {
+		return &ldap.AccountStatus{Found: true, BadPwdCount: 4, BadPasswordTime: time.Now().Add(-time.Hour), Policy: testPolicy}, nil
+	})
+	for i := 0; i < 5; i++ {
+		if ok, reason := guard.Allow(cred("bob")); !ok {
+			t.Fatalf("attempt %d: %s", i+1, reason)
+		}
+	}
+	if ok, _ := guard.Allow(cred("bob")); ok {
+		t.Error("allowed past the threshold")
+	}
+}
+
+func TestGuardSkips(t *testing.T) {
+	lookups := 0
+	guard := testGuard(1, func(name string) (*ldap.AccountStatus, error) {
+		lookups++
+		switch name {
+		case "locked":
+			return &ldap.AccountStatus{Found: true, Locked: true, Policy: testPolicy}, nil
+		case "nolockout":
+			return &ldap.AccountStatus{Found: true, BadPwdCount: 100, BadPasswordTime: time.Now(), Policy: &ldap.LockoutPolicy{}}, nil
+		}
+		return nil, errors.New("connection refused")
+	})
+
+	if ok, _ := guard.Allow(cred("locked")); ok {
+		t.Error("locked account was allowed")
+	}
+	if ok, reason := guard.Allow(cred("nolockout")); !ok {
+		t.Errorf("account without a lockout policy was skipped: %s", reason)
+	}
+
+	// An account we couldn't read is skipped every time, but only looked up once
+	for i := 0; i < 3; i++ {
+		if ok, _ := guard.Allow(cred("unreadable")); ok {
+			t.Error("account we couldn't read was allowed")
+		}
+	}
+	if lookups != 3 {
+		t.Errorf("looked up accounts %d times, want 3", lookups)
+	}
+
+	// Credentials without an account aren't ours to worry about
+	if ok, _ := guard.Allow(cred("")); !ok {
+		t.Error("credential without an account was skipped")
+	}
+}
+
+func TestGuardConcurrent(t *testing.T) {
+	release := make(chan bool)
+	guard := testGuard(1, func(name string) (*ldap.AccountStatus, error) {
+		if name == "slow" {
+			<-release
+		}
+		return &ldap.AccountStatus{Found: true, Policy: testPolicy}, nil
+	})
+
+	// A slow lookup for one account can't hold up the others
+	slow := make(chan bool)
+	go func() {
+		ok, _ := guard.Allow(cred("slow"))
+		slow <- ok
+	}()
+	done := make(chan bool)
+	go func() {
+		ok, _ := guard.Allow(cred("fast"))
+		done <- ok
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("lookup for one account waited on another")
+	}
+	close(release)
+	<-slow
+
+	// Lots of routines at once still only get the attempts there are
+	var wait sync.WaitGroup
+	var mutex sync.Mutex
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			if ok, _ := guard.Allow(cred("busy")); ok {
+				mutex.Lock()
+				allowed++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wait.Wait()
+	if allowed != 4 {
+		t.Errorf("allowed %d attempts, want 4", allowed)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"sort"
 	"strings"
 
 	"github.com/emperorcow/go-netscan/scanners"
@@ -16,6 +17,17 @@ func replaceNewLines(input string) string {
 	return strings.Replace(temp, "\n", "<br>", -1)
 }
 
+// This function takes the extra info a scanner gave us and turns it into a single
+// string of key=value pairs, sorted so every line in the file looks the same.
+func formatInfo(info map[string]string) string {
+	pairs := []string{}
+	for key, value := range info {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "; ")
+}
+
 // A function (probably a single goroutine) that handles writing our results to
 // both the screen and an output file.  Takes an argument of a file connection
 // And then starts a permanent loop that waits for data on the outChan channel
@@ -26,7 +38,7 @@ func runOutput(outFile *os.File, outChan chan scanners.Result) {
 	outDoneWait.Add(1)
 
 	// Write the header row to our CSV
-	outFile.WriteString("'Host','Success','Message','Output'\n")
+	outFile.WriteString("'Host','Username','Password','Success','Message','Output','Info'\n")
 
 	// Write a header to the console
 	fmt.Printf("%-20s  %-20s  %-20s    %s\n", "Hostname", "Username", "Password", "Result")
@@ -46,7 +58,7 @@ func runOutput(outFile *os.File, outChan chan scanners.Result) {
 			}
 
 			// Finally, let's write the string to our output file.
-			outFile.WriteString(fmt.Sprintf("'%s','%s','%s','%t','%s','%s'\n", result.Host, result.Auth.Account, result.Auth.AuthData, result.Status, result.Message, replaceNewLines(result.Output)))
+			outFile.WriteString(fmt.Sprintf("'%s','%s','%s','%t','%s','%s','%s'\n", result.Host, result.Auth.Account, result.Auth.AuthData, result.Status, result.Message, replaceNewLines(result.Output), formatInfo(result.Info)))
 
 		// We'll use runDoneChan to signal that the program is complete (probably out of input).
 		// Once we're done printing all of our output, let's signal that we're done.
@@ -0,0 +1,130 @@
+package scanners
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"time"
+)
+
+// Something that can make network connections for a scanner, like a jump host
+type Dialer interface {
+	Dial(network, address string) (net.Conn, error)
+}
+
+// The dialer scanners connect with.  It dials directly unless main swaps it for one
+// that goes through somewhere else first.
+var DefaultDialer Dialer = DirectDialer{Timeout: 5 * time.Second}
+
+// Whether the default dialer connects straight to targets from whatever address the
+// OS picks.  A few libraries make their own connections, and they only do what the
+// user asked for when this is true.
+func DialsDirect() bool {
+	direct, ok := DefaultDialer.(DirectDialer)
+	return ok && direct.Source == nil
+}
+
+// Connects to an address with the default dialer
+func Dial(network, address string) (net.Conn, error) {
+	return DefaultDialer.Dial(network, address)
+}
+
+// Connects to an address with the default dialer, giving up when the context is done.
+// Dialers that don't take a context are left to finish in the background and whatever
+// they connect gets closed.
+func DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if dialer, ok := DefaultDialer.(interface {
+		DialContext(ctx context.Context, network, address string) (net.Conn, error)
+	}); ok {
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	type dialed struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan dialed, 1)
+	go func() {
+		conn, err := Dial(network, address)
+		done <- dialed{conn, err}
+	}()
+
+	select {
+	case result := <-done:
+		return result.conn, result.err
+	case <-ctx.Done():
+		go func() {
+			if result := <-done; result.conn != nil {
+				result.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// Connects to an address with the default dialer and starts TLS on it.  If the config
+// doesn't name the server we use the host we're connecting to.
+func DialTLS(network, address string, config *tls.Config) (net.Conn, error) {
+	conn, err := Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(address)
+	}
+
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// Hands connections to libraries that want a dialer of their own rather than a
+// function.  It always uses whatever the default dialer is, and has the methods the
+// database drivers look for.
+type LibraryDialer struct{}
+
+func (this LibraryDialer) Dial(network, address string) (net.Conn, error) {
+	return Dial(network, address)
+}
+
+func (this LibraryDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return DialContext(ctx, network, address)
+}
+
+func (this LibraryDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return DialContext(ctx, network, address)
+}
+
+// Connects straight to the target, optionally from a source address we were told to
+// use, for hosts with more than one interface.
+type DirectDialer struct {
+	Timeout time.Duration
+	Source  net.IP // Local address to connect from, nil for whatever the OS picks
+}
+
+func (this DirectDialer) Dial(network, address string) (net.Conn, error) {
+	return this.DialContext(context.Background(), network, address)
+}
+
+func (this DirectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: this.Timeout}
+	if this.Source != nil {
+		// The local address has to be the same kind as the network we're dialing
+		if strings.HasPrefix(network, "udp") {
+			dialer.LocalAddr = &net.UDPAddr{IP: this.Source}
+		} else {
+			dialer.LocalAddr = &net.TCPAddr{IP: this.Source}
+		}
+	}
+	return dialer.DialContext(ctx, network, address)
+}
@@ -0,0 +1,28 @@
+package scanners
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDialsDirect(t *testing.T) {
+	saved := DefaultDialer
+	defer func() { DefaultDialer = saved }()
+
+	tests := []struct {
+		name   string
+		dialer Dialer
+		direct bool
+	}{
+		{"default", DirectDialer{Timeout: 5 * time.Second}, true},
+		{"source address", DirectDialer{Source: net.ParseIP("10.0.0.5")}, false},
+		{"proxy", &httpProxy{}, false},
+	}
+	for _, test := range tests {
+		DefaultDialer = test.dialer
+		if got := DialsDirect(); got != test.direct {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.direct)
+		}
+	}
+}
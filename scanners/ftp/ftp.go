@@ -2,7 +2,6 @@ package ftp
 
 import (
 	"strings"
-	"time"
 
 	"github.com/emperorcow/go-netscan/scanners"
 	"github.com/jlaffaye/ftp"
@@ -53,7 +52,7 @@ func (this Scanner) Scan(target, cmd string, cred scanners.Credential, outChan c
 	// Depending on the authentication type, run the correct connection function
 	switch cred.Type {
 	case "basic":
-		c, err := ftp.Dial(target, ftp.DialWithTimeout(5*time.Second))
+		c, err := ftp.Dial(target, ftp.DialWithDialFunc(scanners.Dial))
 		if err != nil {
 			result.Message = err.Error()
 			result.Status = false
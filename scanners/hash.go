@@ -0,0 +1,25 @@
+package scanners
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// Takes the auth data for an ntlmhash credential, either LMHASH:NTHASH the way
+// secretsdump and pwdump give them to us or just the NT hash, and returns the NT
+// hash since that's the only one we need.  An empty LM hash (:NTHASH) is fine too.
+func NTHash(authData string) (string, error) {
+	hash := strings.TrimSpace(authData)
+	if i := strings.LastIndex(hash, ":"); i >= 0 {
+		hash = hash[i+1:]
+	}
+
+	if len(hash) != 32 {
+		return "", errors.New("NT hash must be 32 hex characters")
+	}
+	if _, err := hex.DecodeString(hash); err != nil {
+		return "", errors.New("NT hash must be 32 hex characters")
+	}
+	return strings.ToLower(hash), nil
+}
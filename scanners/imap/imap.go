@@ -0,0 +1,189 @@
+package imap
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-sasl"
+	"github.com/emperorcow/go-netscan/scanners"
+)
+
+// This is our scanner and does all the work from the main
+type Scanner struct {
+	tlsMode string // How we should use TLS: none, starttls or implicit
+}
+
+// Returns the name of this scanner
+func (this Scanner) Name() string {
+	return "imap"
+}
+
+// Returns a description of this scanner
+func (this Scanner) Description() string {
+	return "Internet Message Access Protocol (IMAP)"
+}
+
+// Returns the types of auth we support in this scanner
+func (this Scanner) SupportedAuthentication() []string {
+	return []string{"basic", "plain"}
+}
+
+// Returns some examples on how to configure the auth info
+func (this Scanner) SupportedAuthenticationExample() map[string]string {
+	return map[string]string{
+		"basic": "USERNAME,PASSWORD (LOGIN)",
+		"plain": "USERNAME,PASSWORD (AUTHENTICATE PLAIN)",
+	}
+}
+
+// Adds our flags to the command line
+func (this *Scanner) RegisterFlags(flags *flag.FlagSet) {
+	flags.StringVar(&this.tlsMode, "imap-tls", "none", "TLS for IMAP (none, starttls, implicit on 993). Certificates are not verified.")
+}
+
+// Runs the actual scan, takes an input of our target, the creds we need to use for this one,
+// a command to run if we have one, and our out channel for results
+func (this Scanner) Scan(target, cmd string, cred scanners.Credential, outChan chan scanners.Result) {
+	// Check our target and see if the default port is there, if not we include it.
+	if !strings.Contains(target, ":") {
+		if this.tlsMode == "implicit" {
+			target = target + ":993"
+		} else {
+			target = target + ":143"
+		}
+	}
+
+	// Let's assume that we connected successfully and declare the data as such, we can edit it later if we failed
+	result := scanners.Result{
+		Host:    target,
+		Auth:    cred,
+		Message: "Successfully connected",
+		Status:  true,
+		Output:  "",
+		Info:    map[string]string{},
+	}
+
+	c, err := this.connect(target)
+	if err != nil {
+		result.Message = err.Error()
+		result.Status = false
+		outChan <- result
+		return
+	}
+	defer c.Logout()
+
+	// Save off what the server will let us do before we log in
+	if caps, err := c.Capability(); err == nil {
+		result.Info["capabilities"] = this.joinCapabilities(caps)
+	}
+
+	// Depending on the authentication type, run the correct login command
+	switch cred.Type {
+	case "basic":
+		err = c.Login(cred.Account, cred.AuthData)
+	case "plain":
+		err = c.Authenticate(sasl.NewPlainClient("", cred.Account, cred.AuthData))
+	}
+
+	// If we got an error, let's set the data properly
+	if err != nil {
+		result.Message = err.Error()
+		result.Status = false
+	}
+
+	// If we didn't get an error and we have a command to run, let's do it.
+	if err == nil && cmd != "" {
+		// Execute the command
+		result.Output, err = this.listMailboxes(c, cmd)
+		if err != nil {
+			// If we got an error, let's give the user some output.
+			result.Output = "Command Error: " + err.Error()
+		}
+	}
+
+	// Finally, let's pass our result to the proper channel to write out to the user
+	outChan <- result
+}
+
+// Connects to the server and sets up TLS the way the user asked.  Returns the client
+// and an error if there was one.
+func (this Scanner) connect(host string) (*client.Client, error) {
+	// We're checking credentials, not certificates, so we'll take whatever the server has
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+
+	var c *client.Client
+	var err error
+	if this.tlsMode == "implicit" {
+		c, err = client.DialWithDialerTLS(scanners.LibraryDialer{}, host, tlsConfig)
+	} else {
+		c, err = client.DialWithDialer(scanners.LibraryDialer{}, host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.Timeout = 30 * time.Second
+
+	if this.tlsMode == "starttls" {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			c.Logout()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Lists every mailbox matching the pattern the user gave us (like *) along with how
+// many messages are in each.  Returns one mailbox per line.
+func (this Scanner) listMailboxes(c *client.Client, pattern string) (string, error) {
+	// The client fills the channel as it reads the response, so we need to be reading
+	// it at the same time.
+	mailboxes := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.List("", pattern, mailboxes)
+	}()
+
+	names := []string{}
+	for mailbox := range mailboxes {
+		names = append(names, mailbox.Name)
+	}
+	if err := <-done; err != nil {
+		return "", err
+	}
+
+	// Now we can ask for the count on each one, some mailboxes can't be selected so
+	// we'll just leave the count off those.
+	lines := []string{}
+	for _, name := range names {
+		status, err := c.Status(name, []imap.StatusItem{imap.StatusMessages})
+		if err != nil {
+			lines = append(lines, name)
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s: %d messages", name, status.Messages))
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// Turns the capabilities map into a sorted, space separated list
+func (this Scanner) joinCapabilities(caps map[string]bool) string {
+	list := []string{}
+	for capability := range caps {
+		list = append(list, capability)
+	}
+	sort.Strings(list)
+	return strings.Join(list, " ")
+}
+
+// Creates a new scanner for us to add to the main loop
+func NewScanner() scanners.Scanner {
+	return &Scanner{}
+}
@@ -0,0 +1,306 @@
+package kerberos
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emperorcow/go-netscan/scanners"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/iana/patype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// The first byte of the two replies a KDC can send us, these are the ASN.1
+// application tags for AS-REP and KRB-ERROR.
+const (
+	tagASRep    = 0x6b
+	tagKRBError = 0x7e
+)
+
+// The biggest reply we'll read from a KDC.  Real ones are a few KB at most, and
+// anything bigger is something else on the port giving us a length it never meant.
+const maxReplySize = 1 << 20
+
+// Friendly names for the encryption types a KDC is likely to hand us
+var etypeNames = map[int32]string{
+	etypeID.DES_CBC_MD5:                "des-cbc-md5",
+	etypeID.AES128_CTS_HMAC_SHA1_96:    "aes128-cts-hmac-sha1-96",
+	etypeID.AES256_CTS_HMAC_SHA1_96:    "aes256-cts-hmac-sha1-96",
+	etypeID.AES128_CTS_HMAC_SHA256_128: "aes128-cts-hmac-sha256-128",
+	etypeID.AES256_CTS_HMAC_SHA384_192: "aes256-cts-hmac-sha384-192",
+	etypeID.RC4_HMAC:                   "rc4-hmac",
+}
+
+// This is our scanner and does all the work from the main
+type Scanner struct {
+	realm string // The realm to use when the account doesn't have one
+}
+
+// Returns the name of this scanner
+func (this Scanner) Name() string {
+	return "kerberos"
+}
+
+// Returns a description of this scanner
+func (this Scanner) Description() string {
+	return "Kerberos pre-authentication (AS-REQ)"
+}
+
+// Returns the types of auth we support in this scanner
+func (this Scanner) SupportedAuthentication() []string {
+	return []string{"basic"}
+}
+
+// Returns some examples on how to configure the auth info
+func (this Scanner) SupportedAuthenticationExample() map[string]string {
+	return map[string]string{
+		"basic": "USERNAME@REALM,PASSWORD or USERNAME,PASSWORD with -kerberos-realm",
+	}
+}
+
+// Adds our flags to the command line
+func (this *Scanner) RegisterFlags(flags *flag.FlagSet) {
+	flags.StringVar(&this.realm, "kerberos-realm", "", "Kerberos realm for accounts that don't include one (user@REALM).")
+}
+
+// Runs the actual scan, takes an input of our target, the creds we need to use for this one,
+// a command to run if we have one, and our out channel for results.  The target is the KDC,
+// and since all we get back is a ticket there's no command to run.
+func (this Scanner) Scan(target, cmd string, cred scanners.Credential, outChan chan scanners.Result) {
+	// Check our target and see if the default port is there, if not we include it.
+	if !strings.Contains(target, ":") {
+		target = target + ":88"
+	}
+
+	// Let's assume that we connected successfully and declare the data as such, we can edit it later if we failed
+	result := scanners.Result{
+		Host:    target,
+		Auth:    cred,
+		Message: "Successfully connected",
+		Status:  true,
+		Output:  "",
+		Info:    map[string]string{},
+	}
+
+	// Depending on the authentication type, run the correct connection function
+	var err error
+	switch cred.Type {
+	case "basic":
+		user, realm := this.splitAccount(cred.Account)
+		if realm == "" {
+			err = errors.New("No realm given, use USERNAME@REALM or -kerberos-realm")
+		} else {
+			err = this.authenticate(target, user, realm, cred.AuthData, result.Info)
+		}
+	}
+
+	// If we got an error, let's set the data properly.  Some KDC errors still tell us the
+	// password was right, so those stay successful.
+	if err != nil {
+		result.Message, result.Status = this.classifyError(err)
+	}
+
+	// Finally, let's pass our result to the proper channel to write out to the user
+	outChan <- result
+}
+
+// Splits an account into the user and realm, taking user@REALM or REALM\user and
+// falling back on the realm from the command line.  Realms are always upper case.
+func (this Scanner) splitAccount(account string) (string, string) {
+	if i := strings.LastIndex(account, "@"); i >= 0 {
+		return account[:i], strings.ToUpper(account[i+1:])
+	}
+	if i := strings.Index(account, "\\"); i >= 0 {
+		return account[i+1:], strings.ToUpper(account[:i])
+	}
+	return account, strings.ToUpper(this.realm)
+}
+
+// Runs through the AS exchange for a user.  We ask for a TGT without any pre-auth
+// first, which tells us how the KDC wants the timestamp encrypted, then ask again with
+// the timestamp.  Anything worth knowing along the way gets put in info.
+func (this Scanner) authenticate(kdc, user, realm, pass string, info map[string]string) error {
+	cfg := config.New()
+	cfg.LibDefaults.NoAddresses = true
+	cname := types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, user)
+
+	req, err := messages.NewASReqForTGT(realm, cfg, cname)
+	if err != nil {
+		return err
+	}
+
+	rep, krbErr, err := this.exchange(kdc, req)
+	if err != nil {
+		return err
+	}
+
+	// If the KDC handed us a ticket without pre-auth, the account can be roasted.  The
+	// password never got checked though, so we see if it opens the reply.
+	if rep != nil {
+		info["preauth"] = "not required"
+		return this.decryptReply(rep, pass)
+	}
+	if krbErr.ErrorCode != errorcode.KDC_ERR_PREAUTH_REQUIRED {
+		return *krbErr
+	}
+
+	// The error tells us which encryption types and salt the KDC has for the user
+	var pas types.PADataSequence
+	if err := pas.Unmarshal(krbErr.EData); err != nil {
+		return err
+	}
+	key, et, err := crypto.GetKeyFromPassword(pass, cname, realm, etypeID.AES256_CTS_HMAC_SHA1_96, pas)
+	if err != nil {
+		return err
+	}
+	info["etype"] = this.etypeName(et.GetETypeID())
+
+	// Now encrypt the time with the key from the password and ask again
+	timestamp, err := types.GetPAEncTSEncAsnMarshalled()
+	if err != nil {
+		return err
+	}
+	encrypted, err := crypto.GetEncryptedData(timestamp, key, keyusage.AS_REQ_PA_ENC_TIMESTAMP, 0)
+	if err != nil {
+		return err
+	}
+	paData, err := encrypted.Marshal()
+	if err != nil {
+		return err
+	}
+	req.PAData = append(req.PAData, types.PAData{
+		PADataType:  patype.PA_ENC_TIMESTAMP,
+		PADataValue: paData,
+	})
+
+	_, krbErr, err = this.exchange(kdc, req)
+	if err != nil {
+		return err
+	}
+	if krbErr != nil {
+		return *krbErr
+	}
+	return nil
+}
+
+// Returns the name of an encryption type, or its number if we don't know it
+func (this Scanner) etypeName(id int32) string {
+	if name, ok := etypeNames[id]; ok {
+		return name
+	}
+	return strconv.Itoa(int(id))
+}
+
+// Tries to open the encrypted part of an AS-REP with the password, which only works
+// if the password was right.
+func (this Scanner) decryptReply(rep *messages.ASRep, pass string) error {
+	key, _, err := crypto.GetKeyFromPassword(pass, rep.CName, rep.CRealm, rep.EncPart.EType, rep.PAData)
+	if err != nil {
+		return err
+	}
+	if _, err := crypto.DecryptEncPart(rep.EncPart, key, keyusage.AS_REP_ENCPART); err != nil {
+		return errors.New("Invalid password")
+	}
+	return nil
+}
+
+// Sends an AS-REQ to the KDC over TCP and reads what comes back, which will either
+// be a ticket or an error.
+func (this Scanner) exchange(kdc string, req messages.ASReq) (*messages.ASRep, *messages.KRBError, error) {
+	b, err := req.Marshal()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn, err := scanners.Dial("tcp", kdc)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	// Kerberos over TCP puts the length of the message in front of it
+	msg := make([]byte, 4, 4+len(b))
+	binary.BigEndian.PutUint32(msg, uint32(len(b)))
+	if _, err := conn.Write(append(msg, b...)); err != nil {
+		return nil, nil, err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length > maxReplySize {
+		return nil, nil, errors.New("Not a KDC, reply length is too big")
+	}
+	reply := make([]byte, length)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, nil, err
+	}
+	if len(reply) == 0 {
+		return nil, nil, errors.New("Empty reply from KDC")
+	}
+
+	switch reply[0] {
+	case tagASRep:
+		var rep messages.ASRep
+		if err := rep.Unmarshal(reply); err != nil {
+			return nil, nil, err
+		}
+		return &rep, nil, nil
+	case tagKRBError:
+		var krbErr messages.KRBError
+		if err := krbErr.Unmarshal(reply); err != nil {
+			return nil, nil, err
+		}
+		return nil, &krbErr, nil
+	default:
+		return nil, nil, errors.New("Unexpected reply from KDC")
+	}
+}
+
+// Takes an error from the exchange and turns it into something that tells the user
+// what happened, along with whether the password was still good.
+func (this Scanner) classifyError(err error) (string, bool) {
+	krbErr, ok := err.(messages.KRBError)
+	if !ok {
+		return err.Error(), false
+	}
+
+	switch krbErr.ErrorCode {
+	case errorcode.KDC_ERR_PREAUTH_FAILED:
+		return "Invalid password", false
+	case errorcode.KDC_ERR_C_PRINCIPAL_UNKNOWN:
+		return "Unknown user", false
+	case errorcode.KDC_ERR_CLIENT_REVOKED:
+		return "Account disabled or locked out", false
+	case errorcode.KDC_ERR_KEY_EXPIRED:
+		// The KDC only checks this after the password, so the password is right
+		return "Valid credentials, but the password has expired", true
+	case errorcode.KRB_AP_ERR_SKEW:
+		return "Clock skew too great between us and the KDC", false
+	case errorcode.KDC_ERR_ETYPE_NOSUPP:
+		return "KDC doesn't support any of our encryption types", false
+	case errorcode.KDC_ERR_WRONG_REALM:
+		return "Wrong realm for this KDC", false
+	default:
+		return errorcode.Lookup(krbErr.ErrorCode), false
+	}
+}
+
+// Creates a new scanner for us to add to the main loop
+func NewScanner() scanners.Scanner {
+	return &Scanner{}
+}
@@ -0,0 +1,224 @@
+package kerberos
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/emperorcow/go-netscan/scanners"
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/iana/patype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// The password our fake KDC has for everyone
+const kdcPassword = "Summer2024!"
+
+// A KDC that knows one password.  Requests without pre-auth get asked for it, unless
+// refuse is set in which case the KDC answers with that straight away.  Requests with
+// the right timestamp get valid back, wrong ones get PREAUTH_FAILED.
+type fakeKDC struct {
+	refuse  int32
+	valid   int32
+	preauth atomic.Bool // Whether we saw a timestamp
+}
+
+// The pre-auth data the KDC sends with PREAUTH_REQUIRED, telling the client to use
+// AES256 with the usual salt for the user
+func preauthData(realm, user string) []byte {
+	info, _ := asn1.Marshal(types.ETypeInfo2{{EType: etypeID.AES256_CTS_HMAC_SHA1_96, Salt: realm + user}})
+	pas, _ := asn1.Marshal(types.PADataSequence{{PADataType: patype.PA_ETYPE_INFO2, PADataValue: info}})
+	return pas
+}
+
+// Works out how to answer a request
+func (this *fakeKDC) reply(req messages.ASReq) int32 {
+	if this.refuse != 0 {
+		return this.refuse
+	}
+	for _, pa := range req.PAData {
+		if pa.PADataType != patype.PA_ENC_TIMESTAMP {
+			continue
+		}
+		this.preauth.Store(true)
+
+		var encrypted types.EncryptedData
+		if err := encrypted.Unmarshal(pa.PADataValue); err != nil {
+			return errorcode.KDC_ERR_PREAUTH_FAILED
+		}
+		var pas types.PADataSequence
+		pas.Unmarshal(preauthData(req.ReqBody.Realm, req.ReqBody.CName.PrincipalNameString()))
+		key, _, err := crypto.GetKeyFromPassword(kdcPassword, req.ReqBody.CName, req.ReqBody.Realm, encrypted.EType, pas)
+		if err != nil {
+			return errorcode.KDC_ERR_PREAUTH_FAILED
+		}
+		if _, err := crypto.DecryptEncPart(encrypted, key, keyusage.AS_REQ_PA_ENC_TIMESTAMP); err != nil {
+			return errorcode.KDC_ERR_PREAUTH_FAILED
+		}
+		return this.valid
+	}
+	return errorcode.KDC_ERR_PREAUTH_REQUIRED
+}
+
+// Listens for requests on a local port and answers each one with a KRB-ERROR
+func (this *fakeKDC) start(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			this.serve(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func (this *fakeKDC) serve(conn net.Conn) {
+	defer conn.Close()
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	b := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return
+	}
+	var req messages.ASReq
+	if err := req.Unmarshal(b); err != nil {
+		return
+	}
+
+	code := this.reply(req)
+	krbErr := messages.NewKRBError(req.ReqBody.SName, req.ReqBody.Realm, code, "")
+	if code == errorcode.KDC_ERR_PREAUTH_REQUIRED {
+		krbErr.EData = preauthData(req.ReqBody.Realm, req.ReqBody.CName.PrincipalNameString())
+	}
+	reply, _ := krbErr.Marshal()
+
+	binary.BigEndian.PutUint32(header, uint32(len(reply)))
+	conn.Write(append(header, reply...))
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		code    int32
+		message string
+		status  bool
+	}{
+		{errorcode.KDC_ERR_PREAUTH_REQUIRED, errorcode.Lookup(errorcode.KDC_ERR_PREAUTH_REQUIRED), false},
+		{errorcode.KDC_ERR_PREAUTH_FAILED, "Invalid password", false},
+		{errorcode.KDC_ERR_C_PRINCIPAL_UNKNOWN, "Unknown user", false},
+		{errorcode.KDC_ERR_CLIENT_REVOKED, "Account disabled or locked out", false},
+		{errorcode.KDC_ERR_KEY_EXPIRED, "Valid credentials, but the password has expired", true},
+	}
+
+	scanner := Scanner{}
+	for _, test := range tests {
+		krbErr := messages.NewKRBError(types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "krbtgt/CORP.LOCAL"), "CORP.LOCAL", test.code, "")
+		message, status := scanner.classifyError(krbErr)
+		if message != test.message || status != test.status {
+			t.Errorf("code %d: got %q %v, want %q %v", test.code, message, status, test.message, test.status)
+		}
+	}
+
+	if message, status := scanner.classifyError(errors.New("connection refused")); message != "connection refused" || status {
+		t.Errorf("got %q %v for a network error", message, status)
+	}
+}
+
+func TestScan(t *testing.T) {
+	tests := []struct {
+		name     string
+		kdc      *fakeKDC
+		password string
+		message  string
+		status   bool
+		preauth  bool
+	}{
+		{"wrong password", &fakeKDC{valid: errorcode.KDC_ERR_KEY_EXPIRED}, "wrong", "Invalid password", false, true},
+		{"expired password", &fakeKDC{valid: errorcode.KDC_ERR_KEY_EXPIRED}, kdcPassword, "Valid credentials, but the password has expired", true, true},
+		{"unknown user", &fakeKDC{refuse: errorcode.KDC_ERR_C_PRINCIPAL_UNKNOWN}, kdcPassword, "Unknown user", false, false},
+		{"revoked", &fakeKDC{refuse: errorcode.KDC_ERR_CLIENT_REVOKED}, kdcPassword, "Account disabled or locked out", false, false},
+	}
+
+	scanner := &Scanner{}
+	for _, test := range tests {
+		target := test.kdc.start(t)
+		out := make(chan scanners.Result, 1)
+		scanner.Scan(target, "", scanners.Credential{Account: "alice@corp.local", AuthData: test.password, Type: "basic"}, out)
+		result := <-out
+
+		if result.Message != test.message || result.Status != test.status {
+			t.Errorf("%s: got %q %v, want %q %v", test.name, result.Message, result.Status, test.message, test.status)
+		}
+		if test.kdc.preauth.Load() != test.preauth {
+			t.Errorf("%s: KDC saw a timestamp %v, want %v", test.name, test.kdc.preauth.Load(), test.preauth)
+		}
+		if test.preauth && result.Info["etype"] != "aes256-cts-hmac-sha1-96" {
+			t.Errorf("%s: got etype %q", test.name, result.Info["etype"])
+		}
+	}
+}
+
+func TestScanNoRealm(t *testing.T) {
+	out := make(chan scanners.Result, 1)
+	(&Scanner{}).Scan("127.0.0.1:1", "", scanners.Credential{Account: "alice", AuthData: "x", Type: "basic"}, out)
+	if result := <-out; result.Status || result.Message != "No realm given, use USERNAME@REALM or -kerberos-realm" {
+		t.Errorf("got %q %v", result.Message, result.Status)
+	}
+}
+
+func TestSplitAccount(t *testing.T) {
+	scanner := Scanner{realm: "default.local"}
+	tests := []struct{ account, user, realm string }{
+		{"alice@corp.local", "alice", "CORP.LOCAL"},
+		{"CORP\\alice", "alice", "CORP"},
+		{"alice", "alice", "DEFAULT.LOCAL"},
+	}
+	for _, test := range tests {
+		if user, realm := scanner.splitAccount(test.account); user != test.user || realm != test.realm {
+			t.Errorf("%s: got %s %s", test.account, user, realm)
+		}
+	}
+}
+
+func TestExchangeNotKDC(t *testing.T) {
+	// A web server answering the request, the first four bytes read as a length of
+	// over a gigabyte
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+	}()
+
+	out := make(chan scanners.Result, 1)
+	(&Scanner{}).Scan(listener.Addr().String(), "", scanners.Credential{Account: "alice@corp.local", AuthData: "x", Type: "basic"}, out)
+	if result := <-out; result.Status || result.Message != "Not a KDC, reply length is too big" {
+		t.Errorf("got %q %v", result.Message, result.Status)
+	}
+}
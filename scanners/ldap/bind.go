@@ -0,0 +1,123 @@
+package ldap
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/emperorcow/go-netscan/scanners"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Active Directory puts the real reason a bind failed in the diagnostic message as
+// "data XXX", these are the ones we know about and whether the password was right.
+var adBindErrors = map[string]struct {
+	message string
+	valid   bool
+}{
+	"525": {"User not found", false},
+	"52e": {"Invalid credentials", false},
+	"530": {"Valid credentials, but not permitted to log on at this time", true},
+	"531": {"Valid credentials, but not permitted to log on from this workstation", true},
+	"532": {"Valid credentials, but the password has expired", true},
+	"533": {"Valid credentials, but the account is disabled", true},
+	"568": {"Valid credentials, but the user is in too many groups", true},
+	"701": {"Valid credentials, but the account has expired", true},
+	"773": {"Valid credentials, but the password must be changed", true},
+	"775": {"Account locked out", false},
+}
+
+// Pulls the data code out of an Active Directory diagnostic message
+var adDataCode = regexp.MustCompile(`data ([0-9a-fA-F]+)`)
+
+// Binds with the type of auth we were asked to use
+func (this Scanner) bind(conn *ldap.Conn, target string, cred scanners.Credential) error {
+	switch cred.Type {
+	case "basic":
+		// No user and no password is an anonymous bind, which the library won't do
+		// through Bind
+		if cred.Account == "" && cred.AuthData == "" {
+			return conn.UnauthenticatedBind("")
+		}
+		return conn.Bind(cred.Account, cred.AuthData)
+	case "ntlm":
+		domain, user := splitDomain(cred.Account)
+		return conn.NTLMBind(domain, user, cred.AuthData)
+	case "ntlmhash":
+		hash, err := scanners.NTHash(cred.AuthData)
+		if err != nil {
+			return err
+		}
+		domain, user := splitDomain(cred.Account)
+		return conn.NTLMBindWithHash(domain, user, hash)
+	case "digest":
+		// DIGEST-MD5 ties the response to the server's name, so it has to be the host
+		return conn.MD5Bind(strings.Split(target, ":")[0], cred.Account, cred.AuthData)
+	case "external":
+		// The client certificate we gave in the handshake is what logs us in
+		if this.tlsMode == "none" {
+			return errors.New("External binds need a client certificate, use -ldap-tls starttls or ldaps")
+		}
+		return conn.ExternalBind()
+	}
+	return errors.New("Unsupported authentication type " + cred.Type)
+}
+
+// Connects and binds in one go for when we're using the directory rather than testing
+// a credential against it.  Bind errors come back as the message classifyError gives.
+func (this Scanner) open(target string, cred scanners.Credential) (*ldap.Conn, error) {
+	target = this.addPort(target)
+	conn, err := this.connect(target, cred)
+	if err != nil {
+		return nil, err
+	}
+	if err := this.bind(conn, target, cred); err != nil {
+		conn.Close()
+		message, _ := classifyError(err)
+		return nil, errors.New("Bind failed: " + message)
+	}
+	return conn, nil
+}
+
+// Splits DOMAIN\USER into its parts, the domain is empty if there isn't one and the
+// server's domain is used.
+func splitDomain(account string) (string, string) {
+	if strings.Contains(account, "\\") {
+		logonInfo := strings.Split(account, "\\")
+		return logonInfo[0], logonInfo[1]
+	}
+	return "", account
+}
+
+// Takes an error from binding and turns it into something that tells the user what
+// happened, along with whether the credentials were still good.  Active Directory
+// gives us more detail than the result code alone in its diagnostic message.
+func classifyError(err error) (string, bool) {
+	ldapErr, ok := err.(*ldap.Error)
+	if !ok {
+		return err.Error(), false
+	}
+
+	switch ldapErr.ResultCode {
+	case ldap.LDAPResultInvalidCredentials:
+		if match := adDataCode.FindStringSubmatch(ldapErr.Err.Error()); match != nil {
+			if adErr, ok := adBindErrors[strings.ToLower(match[1])]; ok {
+				return adErr.message, adErr.valid
+			}
+		}
+		return "Invalid credentials", false
+	case ldap.LDAPResultInappropriateAuthentication:
+		return "Inappropriate authentication, the server doesn't allow this kind of bind", false
+	case ldap.LDAPResultStrongAuthRequired:
+		return "Strong authentication required, try -ldap-tls or a SASL bind", false
+	case ldap.LDAPResultConfidentialityRequired:
+		return "Confidentiality required, try -ldap-tls", false
+	case ldap.LDAPResultAuthMethodNotSupported:
+		return "Authentication method not supported by the server", false
+	case ldap.LDAPResultUnwillingToPerform:
+		return "Server unwilling to perform the bind: " + ldapErr.Err.Error(), false
+	case ldap.ErrorEmptyPassword:
+		return "Empty password, the server would treat this as an anonymous bind", false
+	}
+	return err.Error(), false
+}
@@ -1,14 +1,38 @@
 package ldap
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"strconv"
 	"strings"
 
 	"github.com/emperorcow/go-netscan/scanners"
-	"gopkg.in/ldap.v2"
+	"github.com/go-ldap/ldap/v3"
 )
 
+// How many entries we ask for in each page of search results
+const pageSize = 500
+
+// The scopes the user can pick from for -c searches
+var searchScopes = map[string]int{
+	"base": ldap.ScopeBaseObject,
+	"one":  ldap.ScopeSingleLevel,
+	"sub":  ldap.ScopeWholeSubtree,
+}
+
 // This is our scanner and does all the work from the main
-type Scanner struct{}
+type Scanner struct {
+	baseDN     string // Where searches start, the server's default naming context if empty
+	scope      string // How far down searches go, base, one or sub
+	attributes string // Comma separated attributes to return, all of them if empty
+	tlsMode    string // How we should use TLS: none, starttls or ldaps
+	verify     bool   // Whether we should check the server's certificate
+	caFile     string // CA certificates to check the server against instead of the system's
+}
 
 // Returns the name of this scanner
 func (this Scanner) Name() string {
@@ -22,23 +46,36 @@ func (this Scanner) Description() string {
 
 // Returns the types of auth we support in this scanner
 func (this Scanner) SupportedAuthentication() []string {
-	return []string{"basic"}
+	return []string{"basic", "ntlm", "ntlmhash", "digest", "external"}
 }
 
 // Returns some examples on how to configure the auth info
 func (this Scanner) SupportedAuthenticationExample() map[string]string {
 	return map[string]string{
-		"basic": "USERNAME,PASSWORD",
+		"basic":    "USERNAME,PASSWORD (simple bind, USERNAME can be a DN or user@domain)",
+		"ntlm":     "DOMAIN\\USERNAME,PASSWORD",
+		"ntlmhash": "DOMAIN\\USERNAME,LMHASH:NTHASH (pass-the-hash, the LM hash can be left empty)",
+		"digest":   "USERNAME,PASSWORD (SASL DIGEST-MD5, target must be the server's host name)",
+		"external": "CERTFILE,KEYFILE (SASL EXTERNAL with a PEM client certificate, needs -ldap-tls)",
 	}
 }
 
+// Adds our flags to the command line
+func (this *Scanner) RegisterFlags(flags *flag.FlagSet) {
+	flags.StringVar(&this.baseDN, "ldap-base", "", "Base DN for LDAP searches from -c, the server's defaultNamingContext if empty.")
+	flags.StringVar(&this.scope, "ldap-scope", "sub", "Scope for LDAP searches from -c (base, one, sub).")
+	flags.StringVar(&this.attributes, "ldap-attrs", "", "Comma separated attributes to return from LDAP searches, all of them if empty.")
+	flags.StringVar(&this.tlsMode, "ldap-tls", "none", "TLS for LDAP (none, starttls, ldaps on 636).")
+	flags.BoolVar(&this.verify, "ldap-verify", false, "Verify the certificate of LDAP servers, they aren't checked by default.")
+	flags.StringVar(&this.caFile, "ldap-ca", "", "PEM file of CA certificates to verify LDAP servers with, implies -ldap-verify.")
+}
+
 // Runs the actual scan, takes an input of our target, the creds we need to use for this one,
-// a command to run if we have one, and our out channel for results
+// a command to run if we have one, and our out channel for results.  For LDAP the command
+// is a search filter, like (objectClass=user).
 func (this Scanner) Scan(target, cmd string, cred scanners.Credential, outChan chan scanners.Result) {
-	// Add port 389 to the target if we didn't get a port from the user.
-	if !strings.Contains(target, ":") {
-		target = target + ":389"
-	}
+	// Add port 389 to the target if we didn't get a port from the user, or 636 for LDAPS.
+	target = this.addPort(target)
 
 	// Let's assume that we connected successfully and declare the data as such, we can edit it later if we failed
 	result := scanners.Result{
@@ -47,25 +84,33 @@ func (this Scanner) Scan(target, cmd string, cred scanners.Credential, outChan c
 		Message: "Successfully bound to directory",
 		Status:  true,
 		Output:  "",
+		Info:    map[string]string{},
 	}
 
-	conn, err := ldap.Dial("tcp", target)
-	// Return if we got an error on our setup of our credentials.
+	conn, err := this.connect(target, cred)
+	// Return if we couldn't connect, there's nothing to bind to.
 	if err != nil {
 		result.Message = err.Error()
 		result.Status = false
+		outChan <- result
+		return
 	}
 	defer conn.Close()
 
-	// Bind to the LDAP server and get a connection
-	err = conn.Bind(cred.Account, cred.AuthData)
+	// Bind to the LDAP server with the type of auth we were asked for
+	err = this.bind(conn, target, cred)
 	if err != nil {
-		result.Message = err.Error()
-		result.Status = false
+		// Some errors still mean the password was right, but we can't search with it
+		result.Message, result.Status = classifyError(err)
+		if ldapErr, ok := err.(*ldap.Error); ok {
+			result.Info["result_code"] = strconv.Itoa(int(ldapErr.ResultCode))
+		}
+		outChan <- result
+		return
 	}
 
 	// If we didn't get an error and we have a query to execute then do it.
-	if err == nil && cmd != "" {
+	if cmd != "" {
 		result.Output, err = this.executeQuery(conn, cmd)
 		if err != nil {
 			// If we got an error, let's give the user some output.
@@ -77,19 +122,208 @@ func (this Scanner) Scan(target, cmd string, cred scanners.Credential, outChan c
 	outChan <- result
 }
 
-// Runs an LDAP query on an existing connection and then returns the output as a string
+// Adds the default port to a target that doesn't have one, 389 or 636 for LDAPS
+func (this Scanner) addPort(target string) string {
+	if strings.Contains(target, ":") {
+		return target
+	}
+	if this.tlsMode == "ldaps" {
+		return target + ":636"
+	}
+	return target + ":389"
+}
+
+// Connects to the server with the TLS mode we were told to use.  For external binds
+// the credential is the client certificate, so it's loaded here for the handshake.
+func (this Scanner) connect(target string, cred scanners.Credential) (*ldap.Conn, error) {
+	var tlsConfig *tls.Config
+	if this.tlsMode != "none" {
+		var err error
+		if tlsConfig, err = this.tlsConfig(target, cred); err != nil {
+			return nil, err
+		}
+	}
+
+	switch this.tlsMode {
+	case "none":
+		return dial(target)
+	case "starttls":
+		conn, err := dial(target)
+		if err != nil {
+			return nil, err
+		}
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	case "ldaps":
+		netConn, err := scanners.DialTLS("tcp", target, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		conn := ldap.NewConn(netConn, true)
+		conn.Start()
+		return conn, nil
+	default:
+		return nil, errors.New("Unknown TLS mode " + this.tlsMode + ", use none, starttls or ldaps")
+	}
+}
+
+// Opens a plain connection with our dialer and starts the library up on it
+func dial(target string) (*ldap.Conn, error) {
+	netConn, err := scanners.Dial("tcp", target)
+	if err != nil {
+		return nil, err
+	}
+	conn := ldap.NewConn(netConn, false)
+	conn.Start()
+	return conn, nil
+}
+
+// Builds the TLS settings for a connection.  We don't check certificates unless asked
+// to, since most directories we hit are using ones from an internal CA.
+func (this Scanner) tlsConfig(target string, cred scanners.Credential) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         strings.Split(target, ":")[0],
+		InsecureSkipVerify: !this.verify && this.caFile == "",
+	}
+
+	if this.caFile != "" {
+		pem, err := ioutil.ReadFile(this.caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificates found in " + this.caFile)
+		}
+	}
+
+	if cred.Type == "external" {
+		cert, err := tls.LoadX509KeyPair(cred.Account, cred.AuthData)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// Runs an LDAP search on an existing connection with the query as the filter, pages
+// through all of the results and returns them as LDIF.
 func (this Scanner) executeQuery(conn *ldap.Conn, query string) (string, error) {
-	/*	TODO: Add ability to query
-		searchRequest := ldap.NewSearchRequest(
-			"dc=example,dc=com",
-			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
-			query,
-			[]string{"cn"}, // can it be something else than "cn"?
-			nil,
-		)
-	*/
-
-	return "", nil
+	scope, ok := searchScopes[this.scope]
+	if !ok {
+		return "", errors.New("Unknown search scope " + this.scope + ", use base, one or sub")
+	}
+
+	// If we weren't told where to search, start at the top of the directory
+	baseDN := this.baseDN
+	if baseDN == "" {
+		var err error
+		if baseDN, err = this.defaultNamingContext(conn); err != nil {
+			return "", err
+		}
+	}
+
+	// No attributes asks the server for all of them
+	var attributes []string
+	for _, attribute := range strings.Split(this.attributes, ",") {
+		if attribute = strings.TrimSpace(attribute); attribute != "" {
+			attributes = append(attributes, attribute)
+		}
+	}
+
+	searchRequest := ldap.NewSearchRequest(
+		baseDN,
+		scope, ldap.NeverDerefAliases, 0, 0, false,
+		query,
+		attributes,
+		nil,
+	)
+
+	// Active Directory won't give back more than 1000 entries without paging
+	searchResult, err := conn.SearchWithPaging(searchRequest, pageSize)
+	if err != nil {
+		return "", err
+	}
+
+	return formatLDIF(searchResult.Entries), nil
+}
+
+// Reads the rootDSE to find the naming context the server holds, which is where we
+// start searches when we haven't been told a base DN.
+func (this Scanner) defaultNamingContext(conn *ldap.Conn) (string, error) {
+	searchRequest := ldap.NewSearchRequest(
+		"",
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)",
+		[]string{"defaultNamingContext", "namingContexts"},
+		nil,
+	)
+	searchResult, err := conn.Search(searchRequest)
+	if err != nil {
+		return "", err
+	}
+	if len(searchResult.Entries) == 0 {
+		return "", errors.New("Server didn't return a rootDSE, use -ldap-base")
+	}
+
+	// Active Directory gives us a default, other servers we'll use the first context
+	rootDSE := searchResult.Entries[0]
+	if baseDN := rootDSE.GetAttributeValue("defaultNamingContext"); baseDN != "" {
+		return baseDN, nil
+	}
+	if baseDN := rootDSE.GetAttributeValue("namingContexts"); baseDN != "" {
+		return baseDN, nil
+	}
+	return "", errors.New("Server didn't give a naming context, use -ldap-base")
+}
+
+// Turns search results into LDIF, one entry after another with a blank line between.
+// Values that can't be written as they are, like binary SIDs and GUIDs, are base64.
+func formatLDIF(entries []*ldap.Entry) string {
+	lines := []string{}
+	for i, entry := range entries {
+		if i > 0 {
+			lines = append(lines, "")
+		}
+		lines = append(lines, ldifLine("dn", []byte(entry.DN)))
+		for _, attribute := range entry.Attributes {
+			for _, value := range attribute.ByteValues {
+				lines = append(lines, ldifLine(attribute.Name, value))
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Writes out a single attribute and value, using base64 (name:: value) if the value
+// isn't a safe string under RFC 2849.
+func ldifLine(name string, value []byte) string {
+	if ldifSafe(value) {
+		return name + ": " + string(value)
+	}
+	return name + ":: " + base64.StdEncoding.EncodeToString(value)
+}
+
+// Checks if a value can go in LDIF as is.  It has to be printable ASCII, and can't
+// start with a space, colon or less than, or end with a space.
+func ldifSafe(value []byte) bool {
+	if len(value) == 0 {
+		return true
+	}
+	if value[0] == ' ' || value[0] == ':' || value[0] == '<' || value[len(value)-1] == ' ' {
+		return false
+	}
+	for _, char := range value {
+		if char < 0x20 || char > 0x7e {
+			return false
+		}
+	}
+	return true
 }
 
 // Creates a new scanner for us to add to the main loop
@@ -0,0 +1,233 @@
+package ldap
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// An entry the fake directory hands back
+type testEntry struct {
+	dn         string
+	attributes [][2]string
+}
+
+// A directory on the other end of a pipe that answers searches a couple of entries
+// at a time, using the page number as the cookie.  It keeps what the client asked for
+// so we can check the paging control came through.
+type fakeDirectory struct {
+	entries  []testEntry
+	perPage  int
+	requests []*ldap.ControlPaging
+	baseDNs  []string
+}
+
+// Starts the directory and returns a library connection to it
+func (this *fakeDirectory) start(t *testing.T) *ldap.Conn {
+	client, server := net.Pipe()
+	go this.serve(server)
+
+	conn := ldap.NewConn(client, false)
+	conn.Start()
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func (this *fakeDirectory) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		request := packet.Children[1]
+		if request.Tag != ldap.ApplicationSearchRequest {
+			continue
+		}
+		this.baseDNs = append(this.baseDNs, request.Children[0].Data.String())
+
+		// Find where the client is up to
+		var paging *ldap.ControlPaging
+		if len(packet.Children) > 2 {
+			for _, child := range packet.Children[2].Children {
+				if control, err := ldap.DecodeControl(child); err == nil {
+					if control, ok := control.(*ldap.ControlPaging); ok {
+						paging = control
+					}
+				}
+			}
+		}
+		this.requests = append(this.requests, paging)
+		page := 0
+		if paging != nil && len(paging.Cookie) > 0 {
+			page, _ = strconv.Atoi(string(paging.Cookie))
+		}
+
+		start := page * this.perPage
+		end := start + this.perPage
+		if end > len(this.entries) {
+			end = len(this.entries)
+		}
+		for _, entry := range this.entries[start:end] {
+			conn.Write(entryPacket(id, entry).Bytes())
+		}
+
+		cookie := ""
+		if end < len(this.entries) {
+			cookie = strconv.Itoa(page + 1)
+		}
+		conn.Write(donePacket(id, cookie).Bytes())
+	}
+}
+
+// Wraps a protocol operation in an LDAP message
+func message(id int64, op *ber.Packet) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	packet.AppendChild(op)
+	return packet
+}
+
+func entryPacket(id int64, entry testEntry) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.dn, ""))
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	for _, pair := range entry.attributes {
+		attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, pair[0], ""))
+		values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, pair[1], ""))
+		attribute.AppendChild(values)
+		attributes.AppendChild(attribute)
+	}
+	op.AppendChild(attributes)
+	return message(id, op)
+}
+
+func donePacket(id int64, cookie string) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultDone, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(ldap.LDAPResultSuccess), ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	packet := message(id, op)
+
+	paging := ldap.NewControlPaging(0)
+	paging.SetCookie([]byte(cookie))
+	controls := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "")
+	controls.AppendChild(paging.Encode())
+	packet.AppendChild(controls)
+	return packet
+}
+
+func TestExecuteQueryPages(t *testing.T) {
+	directory := &fakeDirectory{perPage: 2}
+	for i := 1; i <= 5; i++ {
+		directory.entries = append(directory.entries, testEntry{
+			dn:         "CN=user" + strconv.Itoa(i) + ",DC=corp,DC=local",
+			attributes: [][2]string{{"sAMAccountName", "user" + strconv.Itoa(i)}},
+		})
+	}
+	conn := directory.start(t)
+
+	scanner := Scanner{scope: "sub", baseDN: "DC=corp,DC=local"}
+	output, err := scanner.executeQuery(conn, "(objectClass=user)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "dn: CN=user1,DC=corp,DC=local\nsAMAccountName: user1\n\n" +
+		"dn: CN=user2,DC=corp,DC=local\nsAMAccountName: user2\n\n" +
+		"dn: CN=user3,DC=corp,DC=local\nsAMAccountName: user3\n\n" +
+		"dn: CN=user4,DC=corp,DC=local\nsAMAccountName: user4\n\n" +
+		"dn: CN=user5,DC=corp,DC=local\nsAMAccountName: user5"
+	if output != want {
+		t.Errorf("got\n%s\nwant\n%s", output, want)
+	}
+
+	// Three pages, each asking for our page size and handing back the last cookie
+	if len(directory.requests) != 3 {
+		t.Fatalf("got %d searches, want 3", len(directory.requests))
+	}
+	for i, paging := range directory.requests {
+		if paging == nil {
+			t.Fatalf("search %d had no paging control", i)
+		}
+		if paging.PagingSize != pageSize {
+			t.Errorf("search %d asked for %d entries, want %d", i, paging.PagingSize, pageSize)
+		}
+		if cookie := string(paging.Cookie); (i == 0 && cookie != "") || (i > 0 && cookie != strconv.Itoa(i)) {
+			t.Errorf("search %d sent cookie %q", i, cookie)
+		}
+	}
+}
+
+func TestExecuteQueryRootDSE(t *testing.T) {
+	// Without a base DN we look it up first, then search from there
+	directory := &fakeDirectory{perPage: 10, entries: []testEntry{
+		{dn: "", attributes: [][2]string{{"defaultNamingContext", "DC=corp,DC=local"}}},
+	}}
+	conn := directory.start(t)
+
+	if _, err := (Scanner{scope: "base"}).executeQuery(conn, "(objectClass=*)"); err != nil {
+		t.Fatal(err)
+	}
+	if len(directory.baseDNs) != 2 || directory.baseDNs[0] != "" || directory.baseDNs[1] != "DC=corp,DC=local" {
+		t.Errorf("searched %q", directory.baseDNs)
+	}
+
+	if _, err := (Scanner{scope: "everything"}).executeQuery(conn, "(objectClass=*)"); err == nil {
+		t.Error("unknown scope was accepted")
+	}
+}
+
+func TestFormatLDIF(t *testing.T) {
+	entries := []*ldap.Entry{
+		{DN: "CN=Alice,DC=corp,DC=local", Attributes: []*ldap.EntryAttribute{
+			{Name: "cn", ByteValues: [][]byte{[]byte("Alice")}},
+			{Name: "objectSid", ByteValues: [][]byte{{0x01, 0x05, 0x00, 0x00}}},
+			{Name: "memberOf", ByteValues: [][]byte{[]byte("CN=A,DC=corp"), []byte("CN=B,DC=corp")}},
+		}},
+		{DN: "CN=Zoë,DC=corp,DC=local", Attributes: []*ldap.EntryAttribute{
+			{Name: "description", ByteValues: [][]byte{[]byte(" leading space")}},
+		}},
+	}
+
+	want := "dn: CN=Alice,DC=corp,DC=local\n" +
+		"cn: Alice\n" +
+		"objectSid:: AQUAAA==\n" +
+		"memberOf: CN=A,DC=corp\n" +
+		"memberOf: CN=B,DC=corp\n" +
+		"\n" +
+		"dn:: Q049Wm/DqyxEQz1jb3JwLERDPWxvY2Fs\n" +
+		"description:: IGxlYWRpbmcgc3BhY2U="
+	if got := formatLDIF(entries); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestLDIFSafe(t *testing.T) {
+	tests := []struct {
+		value string
+		safe  bool
+	}{
+		{"", true},
+		{"plain value", true},
+		{" leading", false},
+		{"trailing ", false},
+		{":colon", false},
+		{"<less", false},
+		{"inner: colon <ok>", true},
+		{"new\nline", false},
+		{"caf\xc3\xa9", false},
+		{"\x7f", false},
+	}
+	for _, test := range tests {
+		if got := ldifSafe([]byte(test.value)); got != test.safe {
+			t.Errorf("ldifSafe(%q) = %v, want %v", test.value, got, test.safe)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package ldap
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emperorcow/go-netscan/scanners"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// A lockout duration that only ends when an admin unlocks the account
+const Forever = time.Duration(math.MaxInt64)
+
+// Seconds between 1601, where Windows file times start, and 1970
+const fileTimeEpoch = 11644473600
+
+// Lockout settings from the domain or a fine-grained password policy
+type LockoutPolicy struct {
+	Name              string        // Where the policy came from, the domain or a PSO's DN
+	Threshold         int           // Bad passwords before the account locks, zero means it never does
+	ObservationWindow time.Duration // How long a bad password counts against the account
+	Duration          time.Duration // How long the account stays locked out
+}
+
+// Describes the policy in a way we can show the user
+func (this LockoutPolicy) String() string {
+	if this.Threshold == 0 {
+		return this.Name + ": no lockout"
+	}
+	duration := this.Duration.String()
+	if this.Duration == Forever {
+		duration = "until unlocked"
+	}
+	return fmt.Sprintf("%s: lockout after %d bad passwords in %s, locked for %s",
+		this.Name, this.Threshold, this.ObservationWindow, duration)
+}
+
+// What the directory knows about one account's bad passwords.  Note that badPwdCount
+// isn't replicated, so it's only what the DC we asked has seen, the PDC knows the most.
+type AccountStatus struct {
+	Found           bool           // Whether the account is in the directory at all
+	BadPwdCount     int            // Bad passwords since the last good one or reset
+	BadPasswordTime time.Time      // When the last bad password was
+	Locked          bool           // Whether the account is locked out right now
+	Policy          *LockoutPolicy // The policy that applies to the account
+}
+
+// Reads lockout policies and account status from a domain controller, using a
+// credential we've been given for it.  The domain policy and any fine-grained
+// policies we can see are read up front, accounts are looked up as they're asked for.
+type PolicyReader struct {
+	scanner  Scanner
+	target   string
+	cred     scanners.Credential
+	baseDN   string
+	Domain   LockoutPolicy             // The default domain policy
+	Policies map[string]*LockoutPolicy // Fine-grained policies by lower case DN
+	mutex    sync.Mutex                // Accounts can be looked up from several routines at once
+}
+
+// Connects to the DC and reads the domain's lockout policy along with any
+// fine-grained policies the credential can read.  Normally only admins can see
+// those, so we'll also try to read them one at a time as accounts point at them.
+func (this Scanner) NewPolicyReader(target string, cred scanners.Credential) (*PolicyReader, error) {
+	conn, err := this.open(target, cred)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	reader := &PolicyReader{
+		scanner:  this,
+		target:   target,
+		cred:     cred,
+		Policies: map[string]*LockoutPolicy{},
+	}
+
+	if reader.baseDN, err = this.defaultNamingContext(conn); err != nil {
+		return nil, err
+	}
+
+	// The domain's policy lives on the domain object itself
+	domain, err := searchOne(conn, reader.baseDN, ldap.ScopeBaseObject, "(objectClass=*)",
+		[]string{"lockoutThreshold", "lockOutObservationWindow", "lockoutDuration"})
+	if err != nil {
+		return nil, err
+	}
+	if domain == nil {
+		return nil, errors.New("Couldn't read the domain object " + reader.baseDN)
+	}
+	reader.Domain = LockoutPolicy{
+		Name:              "Domain policy",
+		Threshold:         atoi(domain.GetAttributeValue("lockoutThreshold")),
+		ObservationWindow: interval(domain.GetAttributeValue("lockOutObservationWindow")),
+		Duration:          interval(domain.GetAttributeValue("lockoutDuration")),
+	}
+
+	// Not being able to see the fine-grained policies is normal, so errors are ignored
+	searchRequest := ldap.NewSearchRequest(
+		"CN=Password Settings Container,CN=System,"+reader.baseDN,
+		ldap.ScopeSingleLevel, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=msDS-PasswordSettings)",
+		psoAttributes,
+		nil,
+	)
+	if searchResult, err := conn.Search(searchRequest); err == nil {
+		for _, entry := range searchResult.Entries {
+			reader.Policies[strings.ToLower(entry.DN)] = psoPolicy(entry)
+		}
+	}
+
+	return reader, nil
+}
+
+// Looks up an account by its sAMAccountName and works out which policy applies to it.
+// Accounts we can't find get the domain policy with nothing counted against them.
+func (this *PolicyReader) Account(name string) (*AccountStatus, error) {
+	conn, err := this.scanner.open(this.target, this.cred)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	entry, err := searchOne(conn, this.baseDN, ldap.ScopeWholeSubtree,
+		"(&(objectCategory=person)(objectClass=user)(sAMAccountName="+ldap.EscapeFilter(name)+"))",
+		statusAttributes)
+	if err != nil || entry == nil {
+		return &AccountStatus{Policy: &this.Domain}, err
+	}
+	return this.status(conn, entry), nil
+}
+
+// A user account from the directory and its bad password status
+type User struct {
+	Name   string // The sAMAccountName
+	Status *AccountStatus
+}
+
+// Pages through every enabled user account in the domain and returns them with their
+// status, so the caller can leave out the ones that are locked or close to it.
+func (this *PolicyReader) Users() ([]User, error) {
+	conn, err := this.scanner.open(this.target, this.cred)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// The matching rule is a bitwise and, bit 2 of userAccountControl is disabled
+	searchRequest := ldap.NewSearchRequest(
+		this.baseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		"(&(objectCategory=person)(objectClass=user)(!(userAccountControl:1.2.840.113556.1.4.803:=2)))",
+		append([]string{"sAMAccountName"}, statusAttributes...),
+		nil,
+	)
+	searchResult, err := conn.SearchWithPaging(searchRequest, pageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	users := []User{}
+	for _, entry := range searchResult.Entries {
+		if name := entry.GetAttributeValue("sAMAccountName"); name != "" {
+			users = append(users, User{Name: name, Status: this.status(conn, entry)})
+		}
+	}
+	return users, nil
+}
+
+// Returns the domain's DNS name, worked out from its naming context
+func (this *PolicyReader) DomainName() string {
+	parts := []string{}
+	for _, rdn := range strings.Split(this.baseDN, ",") {
+		if pair := strings.SplitN(strings.TrimSpace(rdn), "=", 2); len(pair) == 2 && strings.EqualFold(pair[0], "DC") {
+			parts = append(parts, pair[1])
+		}
+	}
+	return strings.ToLower(strings.Join(parts, "."))
+}
+
+// The attributes we need from a user to work out their status
+var statusAttributes = []string{"badPwdCount", "badPasswordTime", "lockoutTime", "msDS-ResultantPSO"}
+
+// Works out the status of a user we found in the directory
+func (this *PolicyReader) status(conn *ldap.Conn, entry *ldap.Entry) *AccountStatus {
+	status := &AccountStatus{Found: true, Policy: &this.Domain}
+	status.BadPwdCount = atoi(entry.GetAttributeValue("badPwdCount"))
+	status.BadPasswordTime = fileTime(entry.GetAttributeValue("badPasswordTime"))
+
+	// The directory works out which fine-grained policy wins for us, if there is one
+	if pso := entry.GetAttributeValue("msDS-ResultantPSO"); pso != "" {
+		status.Policy = this.pso(conn, pso)
+	}
+
+	// lockoutTime stays set after the lockout runs out until the next logon, so check
+	// it against how long the policy locks accounts for
+	if lockedAt := fileTime(entry.GetAttributeValue("lockoutTime")); !lockedAt.IsZero() {
+		status.Locked = status.Policy.Duration == Forever || time.Since(lockedAt) < status.Policy.Duration
+	}
+
+	return status
+}
+
+// Counts the bad passwords that still count against the account, the ones from
+// outside the observation window have been forgotten.
+func (this *AccountStatus) RecentBadPasswords() int {
+	if time.Since(this.BadPasswordTime) < this.Policy.ObservationWindow {
+		return this.BadPwdCount
+	}
+	return 0
+}
+
+// The attributes we need from a fine-grained password policy
+var psoAttributes = []string{"msDS-LockoutThreshold", "msDS-LockoutObservationWindow", "msDS-LockoutDuration"}
+
+// Finds a fine-grained policy by DN, reading it if we didn't get it up front.  If we
+// can't read it we have no idea what it says, so we fall back to the domain policy.
+func (this *PolicyReader) pso(conn *ldap.Conn, dn string) *LockoutPolicy {
+	this.mutex.Lock()
+	policy, ok := this.Policies[strings.ToLower(dn)]
+	this.mutex.Unlock()
+	if ok {
+		return policy
+	}
+
+	entry, err := searchOne(conn, dn, ldap.ScopeBaseObject, "(objectClass=msDS-PasswordSettings)", psoAttributes)
+	if err != nil || entry == nil {
+		return &this.Domain
+	}
+	policy = psoPolicy(entry)
+
+	this.mutex.Lock()
+	this.Policies[strings.ToLower(dn)] = policy
+	this.mutex.Unlock()
+	return policy
+}
+
+// Reads the lockout settings out of a fine-grained password policy
+func psoPolicy(entry *ldap.Entry) *LockoutPolicy {
+	return &LockoutPolicy{
+		Name:              entry.DN,
+		Threshold:         atoi(entry.GetAttributeValue("msDS-LockoutThreshold")),
+		ObservationWindow: interval(entry.GetAttributeValue("msDS-LockoutObservationWindow")),
+		Duration:          interval(entry.GetAttributeValue("msDS-LockoutDuration")),
+	}
+}
+
+// Runs a search we only want one entry back from, nil if nothing matched
+func searchOne(conn *ldap.Conn, baseDN string, scope int, filter string, attributes []string) (*ldap.Entry, error) {
+	searchRequest := ldap.NewSearchRequest(
+		baseDN,
+		scope, ldap.NeverDerefAliases, 1, 0, false,
+		filter,
+		attributes,
+		nil,
+	)
+	searchResult, err := conn.Search(searchRequest)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(searchResult.Entries) == 0 {
+		return nil, nil
+	}
+	return searchResult.Entries[0], nil
+}
+
+// Turns an attribute into a number, anything that isn't one is zero
+func atoi(value string) int {
+	number, _ := strconv.Atoi(value)
+	return number
+}
+
+// AD keeps lengths of time as negative counts of 100ns, with the smallest number
+// possible meaning forever.
+func interval(value string) time.Duration {
+	ticks, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0
+	}
+	if ticks == math.MinInt64 {
+		return Forever
+	}
+	if ticks < 0 {
+		ticks = -ticks
+	}
+	return time.Duration(ticks) * 100
+}
+
+// AD keeps points in time as counts of 100ns since 1601, zero means never
+func fileTime(value string) time.Time {
+	ticks, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ticks <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(ticks/10000000-fileTimeEpoch, ticks%10000000*100)
+}
@@ -0,0 +1,74 @@
+package ldap
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInterval(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"-18000000000", 30 * time.Minute},
+		{"-9223372036854775808", Forever},
+		{"0", 0},
+		{"", 0},
+		{"junk", 0},
+	}
+
+	for _, test := range tests {
+		if got := interval(test.value); got != test.want {
+			t.Errorf("interval(%q) = %s, want %s", test.value, got, test.want)
+		}
+	}
+}
+
+func TestFileTime(t *testing.T) {
+	// 2020-01-01 00:00:00 UTC
+	want := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if got := fileTime("132223104000000000"); !got.Equal(want) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	for _, never := range []string{"0", "", "-1"} {
+		if got := fileTime(never); !got.IsZero() {
+			t.Errorf("fileTime(%q) = %s, want never", never, got)
+		}
+	}
+}
+
+func TestRecentBadPasswords(t *testing.T) {
+	policy := &LockoutPolicy{Threshold: 5, ObservationWindow: 30 * time.Minute}
+
+	recent := &AccountStatus{BadPwdCount: 3, BadPasswordTime: time.Now().Add(-10 * time.Minute), Policy: policy}
+	if got := recent.RecentBadPasswords(); got != 3 {
+		t.Errorf("got %d recent bad passwords, want 3", got)
+	}
+	old := &AccountStatus{BadPwdCount: 3, BadPasswordTime: time.Now().Add(-time.Hour), Policy: policy}
+	if got := old.RecentBadPasswords(); got != 0 {
+		t.Errorf("got %d bad passwords from outside the window, want 0", got)
+	}
+}
+
+func TestPolicyString(t *testing.T) {
+	tests := []struct {
+		policy LockoutPolicy
+		want   string
+	}{
+		{LockoutPolicy{Name: "Domain policy"}, "Domain policy: no lockout"},
+		{LockoutPolicy{Name: "Domain policy", Threshold: 5, ObservationWindow: 30 * time.Minute, Duration: Forever},
+			"Domain policy: lockout after 5 bad passwords in 30m0s, locked for until unlocked"},
+	}
+	for _, test := range tests {
+		if got := test.policy.String(); got != test.want {
+			t.Errorf("got %q, want %q", got, test.want)
+		}
+	}
+}
+
+func TestDomainName(t *testing.T) {
+	reader := &PolicyReader{baseDN: "DC=Corp, DC=Example,DC=com"}
+	if got := reader.DomainName(); got != "corp.example.com" {
+		t.Errorf("got %q, want corp.example.com", got)
+	}
+}
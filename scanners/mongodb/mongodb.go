@@ -0,0 +1,300 @@
+package mongodb
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emperorcow/go-netscan/scanners"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// This is our scanner and does all the work from the main
+type Scanner struct {
+	authDB string      // The database our users authenticate against
+	useTLS bool        // Whether we should use TLS on our connections
+	probes *probeCache // What we've found out about each server before logging in
+}
+
+// What we found out about a server without logging in.  It's the same for every
+// credential we try, so we only ask once per server.
+type serverProbe struct {
+	once            sync.Once
+	unauthenticated bool   // Whether the server let us in without credentials
+	version         string // The server version, if it told us
+}
+
+// The probes for every server we've scanned, shared by all the routines
+type probeCache struct {
+	mutex  sync.Mutex
+	probes map[string]*serverProbe
+}
+
+// Returns the probe for a server, which hasn't been run yet if we're the first to ask
+func (this *probeCache) get(host string) *serverProbe {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.probes == nil {
+		this.probes = map[string]*serverProbe{}
+	}
+	probe, ok := this.probes[host]
+	if !ok {
+		probe = &serverProbe{}
+		this.probes[host] = probe
+	}
+	return probe
+}
+
+// Returns the name of this scanner
+func (this Scanner) Name() string {
+	return "mongodb"
+}
+
+// Returns a description of this scanner
+func (this Scanner) Description() string {
+	return "MongoDB Database"
+}
+
+// Returns the types of auth we support in this scanner
+func (this Scanner) SupportedAuthentication() []string {
+	return []string{"basic", "scramsha1", "scramsha256"}
+}
+
+// Returns some examples on how to configure the auth info
+func (this Scanner) SupportedAuthenticationExample() map[string]string {
+	return map[string]string{
+		"basic":       "USERNAME,PASSWORD (server picks the SCRAM mechanism)",
+		"scramsha1":   "USERNAME,PASSWORD",
+		"scramsha256": "USERNAME,PASSWORD",
+	}
+}
+
+// Adds our flags to the command line
+func (this *Scanner) RegisterFlags(flags *flag.FlagSet) {
+	flags.StringVar(&this.authDB, "mongodb-authdb", "admin", "Database MongoDB users authenticate against, commands from -c run here too.")
+	flags.BoolVar(&this.useTLS, "mongodb-tls", false, "Use TLS when connecting to MongoDB servers. Certificates are not verified.")
+}
+
+// Runs the actual scan, takes an input of our target, the creds we need to use for this one,
+// a command to run if we have one, and our out channel for results
+func (this Scanner) Scan(target, cmd string, cred scanners.Credential, outChan chan scanners.Result) {
+	// Check our target and see if the default port is there, if not we include it.
+	if !strings.Contains(target, ":") {
+		target = target + ":27017"
+	}
+
+	// Let's assume that we connected successfully and declare the data as such, we can edit it later if we failed
+	result := scanners.Result{
+		Host:    target,
+		Auth:    cred,
+		Message: "Successfully connected",
+		Status:  true,
+		Output:  "",
+		Info:    map[string]string{},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Before we log in, let's see if we even need to.  We'll also grab the version
+	// since the server will tell anyone that.  The first credential for a server does
+	// this, the rest wait for it and use what it found.
+	probe := this.probes.get(target)
+	probe.once.Do(func() {
+		probe.unauthenticated, probe.version = this.checkNoAuth(ctx, target)
+	})
+	if probe.version != "" {
+		result.Info["version"] = probe.version
+	}
+	if probe.unauthenticated {
+		result.Info["unauthenticated"] = "true"
+	} else {
+		result.Info["unauthenticated"] = "false"
+	}
+
+	// Depending on the authentication type, pick the SCRAM mechanism, an empty one
+	// lets the driver ask the server what it supports.
+	var mechanism string
+	switch cred.Type {
+	case "scramsha1":
+		mechanism = "SCRAM-SHA-1"
+	case "scramsha256":
+		mechanism = "SCRAM-SHA-256"
+	}
+
+	client, err := this.connect(ctx, target, &options.Credential{
+		AuthMechanism: mechanism,
+		AuthSource:    this.authDB,
+		Username:      cred.Account,
+		Password:      cred.AuthData,
+	})
+
+	// If we got an error, let's set the data properly
+	if err != nil {
+		result.Status = false
+		if strings.Contains(err.Error(), "AuthenticationFailed") {
+			result.Message = "Authentication failed"
+		} else {
+			result.Message = err.Error()
+		}
+	} else {
+		// We'll be good and hang up when we're done
+		defer client.Disconnect(context.Background())
+	}
+
+	// If we didn't get an error and we have a command to run, let's do it.
+	if err == nil && cmd != "" {
+		// Execute the command
+		result.Output, err = this.executeCommand(ctx, client, cmd)
+		if err != nil {
+			// If we got an error, let's give the user some output.
+			result.Output = "Command Error: " + err.Error()
+		}
+	}
+
+	// Finally, let's pass our result to the proper channel to write out to the user
+	outChan <- result
+}
+
+// Connects to a single server and pings it, which is when the driver actually
+// authenticates.  Returns the client and an error if there was one.
+func (this Scanner) connect(ctx context.Context, host string, cred *options.Credential) (*mongo.Client, error) {
+	opts := options.Client().
+		SetHosts([]string{host}).
+		SetDirect(true).
+		SetConnectTimeout(5 * time.Second).
+		SetDialer(scanners.LibraryDialer{}).
+		SetServerSelectionTimeout(10 * time.Second)
+
+	if cred != nil {
+		opts.SetAuth(*cred)
+	}
+
+	// We're checking credentials, not certificates, so we'll take whatever the server has
+	if this.useTLS {
+		opts.SetTLSConfig(&tls.Config{InsecureSkipVerify: true})
+	}
+
+	client, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// Connects without any credentials and tries to list the databases, which only
+// works if the server doesn't have authentication turned on.  Returns whether we
+// got in and the server version if we could get it.
+func (this Scanner) checkNoAuth(ctx context.Context, host string) (bool, string) {
+	client, err := this.connect(ctx, host, nil)
+	if err != nil {
+		return false, ""
+	}
+	defer client.Disconnect(context.Background())
+
+	// Anyone is allowed to ask for the build info
+	var buildInfo struct {
+		Version string `bson:"version"`
+	}
+	client.Database("admin").RunCommand(ctx, bson.D{{Key: "buildInfo", Value: 1}}).Decode(&buildInfo)
+
+	_, err = client.ListDatabaseNames(ctx, bson.D{})
+	return err == nil, buildInfo.Version
+}
+
+// Runs a command document (like {listDatabases:1}) against the auth database and
+// returns the reply as JSON.
+func (this Scanner) executeCommand(ctx context.Context, client *mongo.Client, cmd string) (string, error) {
+	// Let people leave the quotes off their keys like they would in the shell
+	cmd = quoteKeys(cmd)
+
+	var doc bson.D
+	if err := bson.UnmarshalExtJSON([]byte(cmd), false, &doc); err != nil {
+		return "", err
+	}
+
+	reply, err := client.Database(this.authDB).RunCommand(ctx, doc).Raw()
+	if err != nil {
+		return "", err
+	}
+
+	out, err := bson.MarshalExtJSON(reply, false, false)
+	if err != nil {
+		return "", err
+	}
+
+	return string(out), nil
+}
+
+// Puts quotes around the keys in a command document that the user left them off of,
+// like the listDatabases in {listDatabases:1}, so we can read it as JSON.  A key is a
+// name right after a { or , that's followed by a colon, and anything inside a string
+// is left alone.
+func quoteKeys(cmd string) string {
+	var out strings.Builder
+	inString := false
+	expectKey := false // Whether a key could start here
+	for i := 0; i < len(cmd); i++ {
+		c := cmd[i]
+		switch {
+		case inString:
+			if c == '\\' && i+1 < len(cmd) {
+				out.WriteByte(c)
+				i++
+				c = cmd[i]
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+			expectKey = false
+		case c == '{' || c == ',':
+			expectKey = true
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			// Spaces don't change where we are
+		case expectKey && isKeyChar(c, true):
+			end := i + 1
+			for end < len(cmd) && isKeyChar(cmd[end], false) {
+				end++
+			}
+			expectKey = false
+			if strings.HasPrefix(strings.TrimLeft(cmd[end:], " \t\r\n"), ":") {
+				out.WriteString(`"` + cmd[i:end] + `"`)
+				i = end - 1
+				continue
+			}
+		default:
+			expectKey = false
+		}
+		out.WriteByte(c)
+	}
+	return out.String()
+}
+
+// Checks if a character can be part of a bare key, numbers can't start one
+func isKeyChar(c byte, first bool) bool {
+	switch {
+	case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c == '_', c == '$':
+		return true
+	case c >= '0' && c <= '9':
+		return !first
+	}
+	return false
+}
+
+// Creates a new scanner for us to add to the main loop
+func NewScanner() scanners.Scanner {
+	return &Scanner{probes: &probeCache{}}
+}
@@ -0,0 +1,73 @@
+package mongodb
+
+import (
+	"sync"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestQuoteKeys(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{`{listDatabases:1}`, `{"listDatabases":1}`},
+		{`{ listDatabases : 1 }`, `{ "listDatabases" : 1 }`},
+		{`{"listDatabases":1}`, `{"listDatabases":1}`},
+		{`{find: "users", filter: {"name": "a: b"}}`, `{"find": "users", "filter": {"name": "a: b"}}`},
+		{`{"name": "x, y: z", "{k": "{v:1}"}`, `{"name": "x, y: z", "{k": "{v:1}"}`},
+		{`{a: "say \"hi, b: c\"", d: 1}`, `{"a": "say \"hi, b: c\"", "d": 1}`},
+		{`{a: "ends in a backslash\\", b: 2}`, `{"a": "ends in a backslash\\", "b": 2}`},
+		{`{find: "c", filter: {$or: [{a1: 1}, {_b: 2}]}}`, `{"find": "c", "filter": {"$or": [{"a1": 1}, {"_b": 2}]}}`},
+		{`{count: "c", limit: 5, skip: 1}`, `{"count": "c", "limit": 5, "skip": 1}`},
+		{`{ping: true, 1a: 2}`, `{"ping": true, 1a: 2}`},
+	}
+
+	for _, test := range tests {
+		if got := quoteKeys(test.cmd); got != test.want {
+			t.Errorf("quoteKeys(%s) = %s, want %s", test.cmd, got, test.want)
+		}
+	}
+}
+
+func TestQuoteKeysParses(t *testing.T) {
+	var doc bson.D
+	if err := bson.UnmarshalExtJSON([]byte(quoteKeys(`{find: "users", filter: {name: "a: b", n: {$gt: 1}}}`)), false, &doc); err != nil {
+		t.Fatal(err)
+	}
+	filter := doc[1].Value.(bson.D)
+	if filter[0].Key != "name" || filter[0].Value != "a: b" {
+		t.Errorf("got filter %v", filter)
+	}
+}
+
+func TestProbeOncePerServer(t *testing.T) {
+	cache := &probeCache{}
+
+	// Every routine scanning the same server has to get the same probe, and only
+	// one of them runs it
+	var wait sync.WaitGroup
+	count := 0
+	var mutex sync.Mutex
+	for i := 0; i < 10; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			probe := cache.get("db1:27017")
+			probe.once.Do(func() {
+				mutex.Lock()
+				count++
+				mutex.Unlock()
+			})
+		}()
+	}
+	wait.Wait()
+
+	if count != 1 {
+		t.Errorf("probe ran %d times, want 1", count)
+	}
+	if cache.get("db1:27017") == cache.get("db2:27017") {
+		t.Error("two servers share a probe")
+	}
+}
@@ -0,0 +1,286 @@
+package mssql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/emperorcow/go-netscan/scanners"
+	mssql "github.com/microsoft/go-mssqldb"
+	_ "github.com/microsoft/go-mssqldb/integratedauth/ntlm"
+)
+
+// This is our scanner and does all the work from the main
+type Scanner struct {
+	database string // The database to log in to, empty for the login's default
+	encrypt  string // The TDS encryption mode we'll ask for
+}
+
+// Returns the name of this scanner
+func (this Scanner) Name() string {
+	return "mssql"
+}
+
+// Returns a description of this scanner
+func (this Scanner) Description() string {
+	return "Microsoft SQL Server (TDS)"
+}
+
+// Returns the types of auth we support in this scanner
+func (this Scanner) SupportedAuthentication() []string {
+	return []string{"basic"}
+}
+
+// Returns some examples on how to configure the auth info
+func (this Scanner) SupportedAuthenticationExample() map[string]string {
+	return map[string]string{
+		"basic": "USERNAME,PASSWORD or DOMAIN\\USERNAME,PASSWORD for Windows authentication",
+	}
+}
+
+// Adds our flags to the command line
+func (this *Scanner) RegisterFlags(flags *flag.FlagSet) {
+	flags.StringVar(&this.database, "mssql-db", "", "Database to log in to for SQL Server, the login's default if empty.")
+	flags.StringVar(&this.encrypt, "mssql-encrypt", "false", "TDS encryption for SQL Server (disable, false for login only, true, strict). Certificates are not verified.")
+}
+
+// Runs the actual scan, takes an input of our target, the creds we need to use for this one,
+// a command to run if we have one, and our out channel for results
+func (this Scanner) Scan(target, cmd string, cred scanners.Credential, outChan chan scanners.Result) {
+	// Check our target and see if the default port is there, if not we include it.
+	if !strings.Contains(target, ":") {
+		target = target + ":1433"
+	}
+
+	// Let's assume that we connected successfully and declare the data as such, we can edit it later if we failed
+	result := scanners.Result{
+		Host:    target,
+		Auth:    cred,
+		Message: "Successfully connected",
+		Status:  true,
+		Output:  "",
+	}
+
+	// Our dialer will fill this out from the server's pre-login response
+	prelogin := &preloginInfo{}
+	ctx := context.Background()
+
+	// Depending on the authentication type, run the correct connection function
+	var db *sql.DB
+	var conn *sql.Conn
+	var err error
+	switch cred.Type {
+	case "basic":
+		db, conn, err = this.connect(ctx, target, cred.Account, cred.AuthData, prelogin)
+	}
+
+	// If we got an error, let's set the data properly
+	if err != nil {
+		result.Message, result.Status = this.classifyError(err)
+	} else {
+		// We'll be good and hang up when we're done
+		defer db.Close()
+		defer conn.Close()
+	}
+
+	// Save off what the server told us about itself
+	if prelogin.version != "" {
+		result.Info = map[string]string{
+			"version":    prelogin.version,
+			"encryption": prelogin.encryption,
+		}
+	}
+
+	// If we didn't get an error and we have a command to run, let's do it.
+	if err == nil && cmd != "" {
+		// Execute the command
+		result.Output, err = this.executeQuery(ctx, conn, cmd)
+		if err != nil {
+			// If we got an error, let's give the user some output.
+			result.Output = "Query Error: " + err.Error()
+		}
+	}
+
+	// Finally, let's pass our result to the proper channel to write out to the user
+	outChan <- result
+}
+
+// Opens a single connection to the server, which is where the authentication actually
+// happens.  If the user has a domain on it (DOMAIN\USER) we'll use NTLM for a Windows
+// login, otherwise it's a SQL login.  Returns the pool and the connection and an error
+// if there was one.
+func (this Scanner) connect(ctx context.Context, host, user, pass string, prelogin *preloginInfo) (*sql.DB, *sql.Conn, error) {
+	params := url.Values{
+		"encrypt":                {this.encrypt},
+		"TrustServerCertificate": {"true"},
+		"dial timeout":           {"5"},
+	}
+	if this.database != "" {
+		params.Set("database", this.database)
+	}
+
+	// Check and see if we have a logon domain in our user (DOMAIN\USER)
+	if strings.Contains(user, "\\") {
+		params.Set("authenticator", "ntlm")
+	}
+
+	// Using a URL saves us from having to escape anything in the password ourselves
+	dsn := url.URL{
+		Scheme:   "sqlserver",
+		User:     url.UserPassword(user, pass),
+		Host:     host,
+		RawQuery: params.Encode(),
+	}
+
+	connector, err := mssql.NewConnector(dsn.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	// With strict encryption (TDS 8) the pre-login happens inside TLS, so there's
+	// nothing for us to read on the way past
+	if this.encrypt == "strict" {
+		connector.Dialer = scanners.LibraryDialer{}
+	} else {
+		connector.Dialer = &preloginDialer{info: prelogin}
+	}
+
+	// We only want the one connection out of the pool, and asking for it is what
+	// actually dials and logs in to the server.
+	db := sql.OpenDB(connector)
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+
+	return db, conn, nil
+}
+
+// Takes an error from logging in and works out what it means for the credential.  A
+// few of the login errors only come back once the password has been checked, so
+// those still count as valid.
+func (this Scanner) classifyError(err error) (string, bool) {
+	var sqlErr mssql.Error
+	if !errors.As(err, &sqlErr) {
+		return err.Error(), false
+	}
+
+	switch sqlErr.Number {
+	case 18487, 18488:
+		return "Valid credentials, but the password has expired or must be changed", true
+	case 4060:
+		return "Valid credentials, but could not open the database", true
+	case 18486:
+		return "Account is locked out", false
+	case 18470:
+		return "Account is disabled", false
+	default:
+		return sqlErr.Message, false
+	}
+}
+
+// Runs a SQL query on an existing connection and then returns the result set as a string
+func (this Scanner) executeQuery(ctx context.Context, conn *sql.Conn, query string) (string, error) {
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	return scanners.FormatRows(rows)
+}
+
+// Holds the details we pulled out of the pre-login response from the server
+type preloginInfo struct {
+	version    string // The server version, like 15.0.2000
+	encryption string // What the server said about encryption
+}
+
+// A dialer for the driver which wraps our connections so we can read the pre-login
+// response as it goes by.
+type preloginDialer struct {
+	info *preloginInfo
+}
+
+// Dials the server and wraps the connection
+func (this *preloginDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := scanners.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &preloginConn{Conn: conn, info: this.info}, nil
+}
+
+// A connection that watches the first packet the server sends us, which is the
+// pre-login response unless we're using strict encryption, and then gets out of the way.
+type preloginConn struct {
+	net.Conn
+	info *preloginInfo
+	buf  []byte
+	done bool
+}
+
+// Reads from the connection, copying everything until we've seen the whole response
+func (this *preloginConn) Read(p []byte) (int, error) {
+	n, err := this.Conn.Read(p)
+	if !this.done && n > 0 {
+		this.buf = append(this.buf, p[:n]...)
+
+		// Every TDS packet has an 8 byte header with the total length in it
+		if len(this.buf) >= 8 {
+			length := int(binary.BigEndian.Uint16(this.buf[2:4]))
+			if len(this.buf) >= length && length >= 8 {
+				// Only a reply (type 4) is the pre-login response, anything else
+				// like a TLS record isn't ours to read
+				if this.buf[0] == 0x04 {
+					this.info.parse(this.buf[8:length])
+				}
+				this.done = true
+				this.buf = nil
+			}
+		}
+	}
+	return n, err
+}
+
+// Pulls the version and encryption setting out of a pre-login response.  The response
+// is a list of option tokens with an offset and length into the rest of the packet.
+func (this *preloginInfo) parse(data []byte) {
+	for i := 0; i+5 <= len(data) && data[i] != 0xff; i += 5 {
+		token := data[i]
+		offset := int(binary.BigEndian.Uint16(data[i+1 : i+3]))
+		length := int(binary.BigEndian.Uint16(data[i+3 : i+5]))
+		if offset+length > len(data) {
+			return
+		}
+		value := data[offset : offset+length]
+
+		switch {
+		case token == 0x00 && length >= 4:
+			this.version = fmt.Sprintf("%d.%d.%d", value[0], value[1], binary.BigEndian.Uint16(value[2:4]))
+		case token == 0x01 && length >= 1:
+			switch value[0] {
+			case 0:
+				this.encryption = "off"
+			case 1:
+				this.encryption = "on"
+			case 2:
+				this.encryption = "not supported"
+			case 3:
+				this.encryption = "required"
+			}
+		}
+	}
+}
+
+// Creates a new scanner for us to add to the main loop
+func NewScanner() scanners.Scanner {
+	return &Scanner{}
+}
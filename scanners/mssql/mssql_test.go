@@ -0,0 +1,63 @@
+package mssql
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// A connection that hands back what we give it a few bytes at a time
+type chunkedConn struct {
+	net.Conn
+	data *bytes.Reader
+}
+
+func (this *chunkedConn) Read(p []byte) (int, error) {
+	if len(p) > 3 {
+		p = p[:3]
+	}
+	return this.data.Read(p)
+}
+
+// Reads everything through a pre-login watcher and returns what it found
+func watch(data []byte) *preloginInfo {
+	info := &preloginInfo{}
+	conn := &preloginConn{Conn: &chunkedConn{data: bytes.NewReader(data)}, info: info}
+	io.ReadAll(conn)
+	return info
+}
+
+func TestPrelogin(t *testing.T) {
+	// VERSION 15.0.2000 and ENCRYPTION required, then the terminator
+	options := []byte{
+		0x00, 0x00, 0x0b, 0x00, 0x06,
+		0x01, 0x00, 0x11, 0x00, 0x01,
+		0xff,
+		0x0f, 0x00, 0x07, 0xd0, 0x00, 0x00,
+		0x03,
+	}
+	header := []byte{0x04, 0x01, 0x00, byte(8 + len(options)), 0x00, 0x00, 0x01, 0x00}
+
+	// Anything after the first packet isn't ours to read
+	trailing := []byte{0x04, 0x01, 0x00, 0x0d, 0x00, 0x00, 0x01, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05}
+
+	info := watch(append(append(header, options...), trailing...))
+	if info.version != "15.0.2000" || info.encryption != "required" {
+		t.Errorf("got version %q encryption %q", info.version, info.encryption)
+	}
+}
+
+func TestPreloginSkipsTLS(t *testing.T) {
+	// A TLS record, which is what comes first with strict encryption.  The TDS length
+	// lands on the record's version bytes, and the data is laid out so that reading
+	// it as pre-login options would find a version.
+	record := []byte{0x16, 0x03, 0x03, 0x03, 0x00, 0x02, 0x00, 0x00}
+	record = append(record, 0x00, 0x00, 0x06, 0x00, 0x04, 0xff, 0x01, 0x02, 0x03, 0x04)
+	record = append(record, make([]byte, 0x0303)...)
+
+	info := watch(record)
+	if info.version != "" || info.encryption != "" {
+		t.Errorf("read version %q encryption %q out of a TLS record", info.version, info.encryption)
+	}
+}
@@ -0,0 +1,263 @@
+package mysql
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/emperorcow/go-netscan/scanners"
+	"github.com/go-sql-driver/mysql"
+)
+
+// The network name we register with the driver so that we get to do the dialing
+// ourselves and can read the server handshake as it goes by.
+const dialNetwork = "netscan"
+
+// This is our scanner and does all the work from the main
+type Scanner struct {
+	useTLS bool // Whether we should require TLS on our connections
+}
+
+// Returns the name of this scanner
+func (this Scanner) Name() string {
+	return "mysql"
+}
+
+// Returns a description of this scanner
+func (this Scanner) Description() string {
+	return "MySQL / MariaDB Database"
+}
+
+// Returns the types of auth we support in this scanner
+func (this Scanner) SupportedAuthentication() []string {
+	return []string{"basic"}
+}
+
+// Returns some examples on how to configure the auth info
+func (this Scanner) SupportedAuthenticationExample() map[string]string {
+	return map[string]string{
+		"basic": "USERNAME,PASSWORD",
+	}
+}
+
+// Adds our flags to the command line
+func (this *Scanner) RegisterFlags(flags *flag.FlagSet) {
+	flags.BoolVar(&this.useTLS, "mysql-tls", false, "Require TLS when connecting to MySQL servers. Certificates are not verified.")
+}
+
+// Runs the actual scan, takes an input of our target, the creds we need to use for this one,
+// a command to run if we have one, and our out channel for results
+func (this Scanner) Scan(target, cmd string, cred scanners.Credential, outChan chan scanners.Result) {
+	// Check our target and see if the default port is there, if not we include it.
+	if !strings.Contains(target, ":") {
+		target = target + ":3306"
+	}
+
+	// Let's assume that we connected successfully and declare the data as such, we can edit it later if we failed
+	result := scanners.Result{
+		Host:    target,
+		Auth:    cred,
+		Message: "Successfully connected",
+		Status:  true,
+		Output:  "",
+	}
+
+	// The driver will hand this back to our dialer so we can fill it out from the
+	// handshake, even if the login ends up failing.
+	greeting := &handshake{}
+	ctx := context.WithValue(context.Background(), handshakeKey{}, greeting)
+
+	// Depending on the authentication type, run the correct connection function
+	var db *sql.DB
+	var conn *sql.Conn
+	var err error
+	switch cred.Type {
+	case "basic":
+		db, conn, err = this.connect(ctx, target, cred.Account, cred.AuthData)
+	}
+
+	// If we got an error, let's set the data properly
+	if err != nil {
+		result.Message = err.Error()
+		result.Status = false
+	} else {
+		// We'll be good and hang up when we're done
+		defer db.Close()
+		defer conn.Close()
+	}
+
+	// Save off what the server told us about itself
+	if greeting.version != "" {
+		result.Info = map[string]string{
+			"version":     greeting.version,
+			"auth_plugin": greeting.plugin,
+		}
+	}
+
+	// If we didn't get an error and we have a command to run, let's do it.
+	if err == nil && cmd != "" {
+		// Execute the command
+		result.Output, err = this.executeQuery(ctx, conn, cmd)
+		if err != nil {
+			// If we got an error, let's give the user some output.
+			result.Output = "Query Error: " + err.Error()
+		}
+	}
+
+	// Finally, let's pass our result to the proper channel to write out to the user
+	outChan <- result
+}
+
+// Builds a configuration for the driver and opens a single connection to the server,
+// which is where the authentication actually happens.  The driver will pick between
+// mysql_native_password and caching_sha2_password based on what the server asks for.
+// Returns the pool and the connection and an error if there was one.
+func (this Scanner) connect(ctx context.Context, host, user, pass string) (*sql.DB, *sql.Conn, error) {
+	cfg := mysql.NewConfig()
+	cfg.Net = dialNetwork
+	cfg.Addr = host
+	cfg.User = user
+	cfg.Passwd = pass
+	cfg.Timeout = 5 * time.Second
+	cfg.ReadTimeout = 30 * time.Second
+	cfg.WriteTimeout = 30 * time.Second
+	// The driver likes to log every failure to stderr, which makes a mess of our output
+	cfg.Logger = log.New(ioutil.Discard, "", 0)
+
+	// We're checking credentials, not certificates, so we'll take whatever the server has
+	if this.useTLS {
+		cfg.TLS = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	connector, err := mysql.NewConnector(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// We only want the one connection out of the pool, and asking for it is what
+	// actually dials and logs in to the server.
+	db := sql.OpenDB(connector)
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+
+	return db, conn, nil
+}
+
+// Runs a SQL query on an existing connection and then returns the result set as a string
+func (this Scanner) executeQuery(ctx context.Context, conn *sql.Conn, query string) (string, error) {
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	return scanners.FormatRows(rows)
+}
+
+// Used as a key to pass our handshake through the driver on the context
+type handshakeKey struct{}
+
+// Holds the details we pulled out of the initial handshake packet from the server
+type handshake struct {
+	version string // The server version string
+	plugin  string // The default authentication plugin the server asked for
+}
+
+// Dials the server for the driver, and if we were given a handshake on the context,
+// wraps the connection so we can read it.
+func dialContext(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := scanners.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if greeting, ok := ctx.Value(handshakeKey{}).(*handshake); ok {
+		return &handshakeConn{Conn: conn, greeting: greeting}, nil
+	}
+	return conn, nil
+}
+
+// A connection that watches the first packet the server sends us, which is always
+// the handshake, and then gets out of the way.
+type handshakeConn struct {
+	net.Conn
+	greeting *handshake
+	buf      []byte
+	done     bool
+}
+
+// Reads from the connection, copying everything until we've seen the whole handshake
+func (this *handshakeConn) Read(p []byte) (int, error) {
+	n, err := this.Conn.Read(p)
+	if !this.done && n > 0 {
+		this.buf = append(this.buf, p[:n]...)
+
+		// Every packet starts with a 3 byte length and a sequence number
+		if len(this.buf) >= 4 {
+			length := int(this.buf[0]) | int(this.buf[1])<<8 | int(this.buf[2])<<16
+			if len(this.buf) >= 4+length {
+				this.greeting.parse(this.buf[4 : 4+length])
+				this.done = true
+				this.buf = nil
+			}
+		}
+	}
+	return n, err
+}
+
+// Pulls the version and auth plugin out of a protocol 10 handshake packet.  Anything
+// we don't understand (like an error packet because our host is blocked) is skipped.
+func (this *handshake) parse(data []byte) {
+	if len(data) == 0 || data[0] != 10 {
+		return
+	}
+	data = data[1:]
+
+	// The version is a null terminated string
+	end := bytes.IndexByte(data, 0)
+	if end < 0 {
+		return
+	}
+	this.version = string(data[:end])
+	data = data[end+1:]
+
+	// Skip the connection id, first part of the scramble, filler, capability flags,
+	// character set, status flags, upper capability flags, scramble length and the
+	// reserved bytes, then the rest of the scramble.  What's left is the plugin name.
+	if len(data) < 31 {
+		return
+	}
+	scrambleLen := int(data[20])
+	data = data[31:]
+	skip := scrambleLen - 8
+	if skip < 13 {
+		skip = 13
+	}
+	if len(data) < skip {
+		return
+	}
+	data = data[skip:]
+	if end := bytes.IndexByte(data, 0); end >= 0 {
+		data = data[:end]
+	}
+	this.plugin = string(data)
+}
+
+func init() {
+	mysql.RegisterDialContext(dialNetwork, dialContext)
+}
+
+// Creates a new scanner for us to add to the main loop
+func NewScanner() scanners.Scanner {
+	return &Scanner{}
+}
@@ -0,0 +1,28 @@
+package scanners
+
+// What Windows tells us when a logon didn't work over SMB or RDP.  The credentials
+// are still good for the expired and restricted ones.
+var ntStatusMessages = map[uint32]struct {
+	message string
+	valid   bool
+}{
+	0xc000006d: {"Logon failed", false},
+	0xc000006a: {"Invalid password", false},
+	0xc0000064: {"Unknown user", false},
+	0xc0000234: {"Account locked out", false},
+	0xc0000072: {"Account disabled", false},
+	0xc0000193: {"Account expired", false},
+	0xc000006e: {"Account restrictions prevent this logon", false},
+	0xc000006f: {"Valid credentials, but not allowed to log on at this time", true},
+	0xc0000070: {"Valid credentials, but not allowed to log on from this workstation", true},
+	0xc0000071: {"Valid credentials, but the password has expired", true},
+	0xc0000224: {"Valid credentials, but the password must be changed", true},
+	0xc000015b: {"Valid credentials, but not granted this type of logon", true},
+}
+
+// Looks up the NTSTATUS from a failed logon.  Returns a message for the user, whether
+// the credentials were still good, and false if it isn't a code we know about.
+func NTStatusMessage(code uint32) (string, bool, bool) {
+	status, ok := ntStatusMessages[code]
+	return status.message, status.valid, ok
+}
@@ -0,0 +1,248 @@
+package pop3
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/emperorcow/go-netscan/scanners"
+)
+
+// This is our scanner and does all the work from the main
+type Scanner struct {
+	tlsMode string // How we should use TLS: none, starttls or implicit
+}
+
+// Returns the name of this scanner
+func (this Scanner) Name() string {
+	return "pop3"
+}
+
+// Returns a description of this scanner
+func (this Scanner) Description() string {
+	return "Post Office Protocol (POP3)"
+}
+
+// Returns the types of auth we support in this scanner
+func (this Scanner) SupportedAuthentication() []string {
+	return []string{"basic", "plain"}
+}
+
+// Returns some examples on how to configure the auth info
+func (this Scanner) SupportedAuthenticationExample() map[string]string {
+	return map[string]string{
+		"basic": "USERNAME,PASSWORD (USER/PASS)",
+		"plain": "USERNAME,PASSWORD (AUTH PLAIN)",
+	}
+}
+
+// Adds our flags to the command line
+func (this *Scanner) RegisterFlags(flags *flag.FlagSet) {
+	flags.StringVar(&this.tlsMode, "pop3-tls", "none", "TLS for POP3 (none, starttls, implicit on 995). Certificates are not verified.")
+}
+
+// Runs the actual scan, takes an input of our target, the creds we need to use for this one,
+// a command to run if we have one, and our out channel for results
+func (this Scanner) Scan(target, cmd string, cred scanners.Credential, outChan chan scanners.Result) {
+	// Check our target and see if the default port is there, if not we include it.
+	if !strings.Contains(target, ":") {
+		if this.tlsMode == "implicit" {
+			target = target + ":995"
+		} else {
+			target = target + ":110"
+		}
+	}
+
+	// Let's assume that we connected successfully and declare the data as such, we can edit it later if we failed
+	result := scanners.Result{
+		Host:    target,
+		Auth:    cred,
+		Message: "Successfully connected",
+		Status:  true,
+		Output:  "",
+		Info:    map[string]string{},
+	}
+
+	c, err := this.connect(target)
+	if err != nil {
+		result.Message = err.Error()
+		result.Status = false
+		outChan <- result
+		return
+	}
+	defer c.Close()
+
+	// Save off the banner and what the server will let us do before we log in
+	result.Info["banner"] = c.banner
+	if caps, err := c.capabilities(); err == nil {
+		result.Info["capabilities"] = strings.Join(caps, " ")
+	}
+
+	// Depending on the authentication type, run the correct login commands
+	switch cred.Type {
+	case "basic":
+		if _, err = c.cmd("USER " + cred.Account); err == nil {
+			_, err = c.cmd("PASS " + cred.AuthData)
+		}
+	case "plain":
+		auth := base64.StdEncoding.EncodeToString([]byte("\x00" + cred.Account + "\x00" + cred.AuthData))
+		_, err = c.cmd("AUTH PLAIN " + auth)
+	}
+
+	// If we got an error, let's set the data properly
+	if err != nil {
+		result.Message = err.Error()
+		result.Status = false
+	}
+
+	// If we didn't get an error and we have a command to run, let's do it.
+	if err == nil && cmd != "" {
+		// Execute the command
+		result.Output, err = this.executeCommand(c, cmd)
+		if err != nil {
+			// If we got an error, let's give the user some output.
+			result.Output = "Command Error: " + err.Error()
+		}
+	}
+
+	// Finally, let's pass our result to the proper channel to write out to the user
+	outChan <- result
+}
+
+// Connects to the server, reads the banner and sets up TLS the way the user asked.
+// Returns the client and an error if there was one.
+func (this Scanner) connect(host string) (*client, error) {
+	// We're checking credentials, not certificates, so we'll take whatever the server has
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+
+	var conn net.Conn
+	var err error
+	if this.tlsMode == "implicit" {
+		conn, err = scanners.DialTLS("tcp", host, tlsConfig)
+	} else {
+		conn, err = scanners.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := newClient(conn)
+	if c.banner, err = c.response(); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	if this.tlsMode == "starttls" {
+		if _, err := c.cmd("STLS"); err != nil {
+			c.Close()
+			return nil, err
+		}
+		banner := c.banner
+		c = newClient(tls.Client(conn, tlsConfig))
+		c.banner = banner
+	}
+
+	return c, nil
+}
+
+// Sends any command the user gave us (like STAT or LIST) and returns the response.
+// Commands that answer with a list give us back every line of it.
+func (this Scanner) executeCommand(c *client, cmd string) (string, error) {
+	status, err := c.cmd(cmd)
+	if err != nil {
+		return "", err
+	}
+
+	if !this.isMultiLine(cmd) {
+		return status, nil
+	}
+
+	lines, err := c.text.ReadDotLines()
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(append([]string{status}, lines...), "\n"), nil
+}
+
+// Works out if a command will get a multi-line response from the server.  LIST and
+// UIDL only do when they're not given a message number.
+func (this Scanner) isMultiLine(cmd string) bool {
+	fields := strings.Fields(strings.ToUpper(cmd))
+	if len(fields) == 0 {
+		return false
+	}
+
+	switch fields[0] {
+	case "LIST", "UIDL":
+		return len(fields) == 1
+	case "RETR", "TOP", "CAPA":
+		return true
+	default:
+		return false
+	}
+}
+
+// A small POP3 client, all we need is to send commands and read responses
+type client struct {
+	conn   net.Conn
+	text   *textproto.Conn
+	banner string // The greeting the server sent when we connected
+}
+
+// Wraps a connection in a client, making sure it can't hang on us forever
+func newClient(conn net.Conn) *client {
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	return &client{
+		conn: conn,
+		text: textproto.NewConn(conn),
+	}
+}
+
+// Sends a command and reads the status line that comes back
+func (this *client) cmd(line string) (string, error) {
+	if err := this.text.PrintfLine("%s", line); err != nil {
+		return "", err
+	}
+	return this.response()
+}
+
+// Reads a status line from the server, returning an error if it was -ERR
+func (this *client) response() (string, error) {
+	line, err := this.text.ReadLine()
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case strings.HasPrefix(line, "+OK"):
+		return strings.TrimSpace(line[3:]), nil
+	case strings.HasPrefix(line, "-ERR"):
+		return "", errors.New(strings.TrimSpace(line[4:]))
+	default:
+		return "", errors.New("unexpected response: " + line)
+	}
+}
+
+// Asks the server what it supports with CAPA
+func (this *client) capabilities() ([]string, error) {
+	if _, err := this.cmd("CAPA"); err != nil {
+		return nil, err
+	}
+	return this.text.ReadDotLines()
+}
+
+// Says goodbye to the server and closes the connection
+func (this *client) Close() error {
+	this.cmd("QUIT")
+	return this.text.Close()
+}
+
+// Creates a new scanner for us to add to the main loop
+func NewScanner() scanners.Scanner {
+	return &Scanner{}
+}
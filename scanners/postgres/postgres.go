@@ -0,0 +1,191 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"net/url"
+	"strings"
+
+	"github.com/emperorcow/go-netscan/scanners"
+	"github.com/lib/pq"
+)
+
+// This is our scanner and does all the work from the main
+type Scanner struct {
+	database string // The database to log in to when the credential doesn't name one
+	sslMode  string // How we should negotiate SSL with the server
+}
+
+// Returns the name of this scanner
+func (this Scanner) Name() string {
+	return "postgres"
+}
+
+// Returns a description of this scanner
+func (this Scanner) Description() string {
+	return "PostgreSQL Database"
+}
+
+// Returns the types of auth we support in this scanner
+func (this Scanner) SupportedAuthentication() []string {
+	return []string{"basic", "database"}
+}
+
+// Returns some examples on how to configure the auth info
+func (this Scanner) SupportedAuthenticationExample() map[string]string {
+	return map[string]string{
+		"basic":    "USERNAME,PASSWORD",
+		"database": "USERNAME,PASSWORD,DATABASE",
+	}
+}
+
+// Adds our flags to the command line
+func (this *Scanner) RegisterFlags(flags *flag.FlagSet) {
+	flags.StringVar(&this.database, "postgres-db", "postgres", "Database to log in to for PostgreSQL when the credential doesn't give one.")
+	flags.StringVar(&this.sslMode, "postgres-ssl", "prefer", "SSL mode for PostgreSQL (disable, prefer, require). Certificates are not verified.")
+}
+
+// Runs the actual scan, takes an input of our target, the creds we need to use for this one,
+// a command to run if we have one, and our out channel for results
+func (this Scanner) Scan(target, cmd string, cred scanners.Credential, outChan chan scanners.Result) {
+	// Check our target and see if the default port is there, if not we include it.
+	if !strings.Contains(target, ":") {
+		target = target + ":5432"
+	}
+
+	// Let's assume that we connected successfully and declare the data as such, we can edit it later if we failed
+	result := scanners.Result{
+		Host:    target,
+		Auth:    cred,
+		Message: "Successfully connected",
+		Status:  true,
+		Output:  "",
+	}
+
+	ctx := context.Background()
+	user, pass, database := cred.Account, cred.AuthData, this.database
+
+	// Depending on the authentication type, figure out where the password and database are
+	switch cred.Type {
+	case "database":
+		// The database is after the last comma so that passwords can still have them
+		if i := strings.LastIndex(cred.AuthData, ","); i >= 0 {
+			pass = cred.AuthData[:i]
+			database = cred.AuthData[i+1:]
+		}
+	}
+
+	// The driver handles cleartext, MD5 and SCRAM-SHA-256 for us based on what the
+	// server asks for.
+	db, conn, err := this.connect(ctx, target, user, pass, database)
+
+	// If we got an error, let's set the data properly
+	if err != nil {
+		result.Message, result.Status = this.classifyError(err, database)
+	} else {
+		// We'll be good and hang up when we're done
+		defer db.Close()
+		defer conn.Close()
+
+		// Let's grab the version while we're in
+		var version string
+		if conn.QueryRowContext(ctx, "SHOW server_version").Scan(&version) == nil {
+			result.Info = map[string]string{"version": version}
+		}
+	}
+
+	// If we didn't get an error and we have a command to run, let's do it.
+	if err == nil && cmd != "" {
+		// Execute the command
+		result.Output, err = this.executeQuery(ctx, conn, cmd)
+		if err != nil {
+			// If we got an error, let's give the user some output.
+			result.Output = "Query Error: " + err.Error()
+		}
+	}
+
+	// Finally, let's pass our result to the proper channel to write out to the user
+	outChan <- result
+}
+
+// Opens a single connection to the server, which is where the authentication actually
+// happens.  If we're set to prefer SSL and the server doesn't support it, we'll try
+// again without it.  Returns the pool and the connection and an error if there was one.
+func (this Scanner) connect(ctx context.Context, host, user, pass, database string) (*sql.DB, *sql.Conn, error) {
+	mode := this.sslMode
+	if mode == "prefer" {
+		db, conn, err := this.open(ctx, host, user, pass, database, "require")
+		if !errors.Is(err, pq.ErrSSLNotSupported) {
+			return db, conn, err
+		}
+		mode = "disable"
+	}
+
+	return this.open(ctx, host, user, pass, database, mode)
+}
+
+// Builds a connection string for the driver and opens a connection with it
+func (this Scanner) open(ctx context.Context, host, user, pass, database, mode string) (*sql.DB, *sql.Conn, error) {
+	// Using a URL saves us from having to escape anything in the password ourselves
+	dsn := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(user, pass),
+		Host:     host,
+		Path:     "/" + database,
+		RawQuery: url.Values{"sslmode": {mode}, "connect_timeout": {"5"}}.Encode(),
+	}
+
+	connector, err := pq.NewConnector(dsn.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	connector.Dialer(scanners.LibraryDialer{})
+
+	// We only want the one connection out of the pool, and asking for it is what
+	// actually dials and logs in to the server.
+	db := sql.OpenDB(connector)
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+
+	return db, conn, nil
+}
+
+// Takes an error from logging in and works out what it means for the credential.  The
+// server checks the password before it looks for the database, so if the database
+// is missing we know the credential was still good.
+func (this Scanner) classifyError(err error, database string) (string, bool) {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return err.Error(), false
+	}
+
+	switch pqErr.Code {
+	case "3D000":
+		return "Valid credentials, but database \"" + database + "\" does not exist", true
+	case "28P01":
+		return "Invalid password", false
+	default:
+		return pqErr.Message, false
+	}
+}
+
+// Runs a SQL query on an existing connection and then returns the result set as a string
+func (this Scanner) executeQuery(ctx context.Context, conn *sql.Conn, query string) (string, error) {
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	return scanners.FormatRows(rows)
+}
+
+// Creates a new scanner for us to add to the main loop
+func NewScanner() scanners.Scanner {
+	return &Scanner{}
+}
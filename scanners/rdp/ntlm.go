@@ -0,0 +1,251 @@
+package rdp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rc4"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+// The NTLM negotiate flags we ask for.  CredSSP needs signing and sealing so the
+// public key can be sent back and forth.
+const (
+	ntlmUnicode            = 0x00000001
+	ntlmRequestTarget      = 0x00000004
+	ntlmSign               = 0x00000010
+	ntlmSeal               = 0x00000020
+	ntlmNTLM               = 0x00000200
+	ntlmAlwaysSign         = 0x00008000
+	ntlmExtendedSessionSec = 0x00080000
+	ntlmTargetInfo         = 0x00800000
+	ntlm128                = 0x20000000
+	ntlmKeyExch            = 0x40000000
+	ntlm56                 = 0x80000000
+
+	ntlmDefaultFlags = ntlmUnicode | ntlmRequestTarget | ntlmSign | ntlmSeal | ntlmNTLM |
+		ntlmAlwaysSign | ntlmExtendedSessionSec | ntlmTargetInfo | ntlm128 | ntlmKeyExch | ntlm56
+)
+
+// The AV pairs in the challenge's target info that we care about
+const (
+	avEOL             = 0
+	avNbComputerName  = 1
+	avNbDomainName    = 2
+	avDnsComputerName = 3
+	avDnsDomainName   = 4
+	avTimestamp       = 7
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// An NTLM client for a single authentication.  It holds on to the keys from the
+// exchange so we can seal messages afterwards.
+type ntlmClient struct {
+	domain     string
+	user       string
+	ntHash     []byte
+	flags      uint32
+	targetInfo map[uint16][]byte // The AV pairs the server sent with its challenge
+	signingKey []byte
+	sealer     *rc4.Cipher
+	seq        uint32
+}
+
+// Creates a client that will log in with a password
+func newNTLMClient(domain, user, pass string) *ntlmClient {
+	hash := md4.New()
+	hash.Write(toUnicode(pass))
+	return &ntlmClient{
+		domain: domain,
+		user:   user,
+		ntHash: hash.Sum(nil),
+	}
+}
+
+// Builds the NEGOTIATE message that starts things off.  We don't send a domain or
+// workstation, the server doesn't need them.
+func (this *ntlmClient) negotiate() []byte {
+	msg := make([]byte, 32)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 1)
+	binary.LittleEndian.PutUint32(msg[12:], ntlmDefaultFlags)
+	return msg
+}
+
+// Takes the server's CHALLENGE and builds the AUTHENTICATE message that answers it
+// with an NTLMv2 response.
+func (this *ntlmClient) authenticate(challenge []byte) ([]byte, error) {
+	if len(challenge) < 48 || !bytes.Equal(challenge[:8], ntlmSignature) || binary.LittleEndian.Uint32(challenge[8:]) != 2 {
+		return nil, errors.New("Invalid NTLM challenge")
+	}
+	this.flags = binary.LittleEndian.Uint32(challenge[20:]) & ntlmDefaultFlags
+	serverChallenge := challenge[24:32]
+
+	rawTargetInfo, err := this.field(challenge, 40)
+	if err != nil {
+		return nil, err
+	}
+	this.targetInfo = this.parseAVPairs(rawTargetInfo)
+
+	// Use the server's time if it gave us one so we don't have to worry about skew
+	timestamp, ok := this.targetInfo[avTimestamp]
+	if !ok {
+		timestamp = make([]byte, 8)
+		binary.LittleEndian.PutUint64(timestamp, uint64(time.Now().UnixNano()/100+116444736000000000))
+	}
+	clientChallenge := make([]byte, 8)
+	if _, err := rand.Read(clientChallenge); err != nil {
+		return nil, err
+	}
+
+	// The NTLMv2 response is an HMAC over the challenges, the time and the target info
+	ntowf := hmacMD5(this.ntHash, toUnicode(strings.ToUpper(this.user)+this.domain))
+	temp := bytes.Join([][]byte{
+		{1, 1, 0, 0, 0, 0, 0, 0},
+		timestamp,
+		clientChallenge,
+		{0, 0, 0, 0},
+		rawTargetInfo,
+		{0, 0, 0, 0},
+	}, nil)
+	proof := hmacMD5(ntowf, serverChallenge, temp)
+	ntResponse := append(proof, temp...)
+
+	// When the server sends a time it wants an empty LM response
+	lmResponse := make([]byte, 24)
+	if !ok {
+		lmResponse = append(hmacMD5(ntowf, serverChallenge, clientChallenge), clientChallenge...)
+	}
+
+	// Work out the key we'll use from here on, and if we're exchanging keys pick a
+	// random one and send it over encrypted with the one we worked out.
+	sessionKey := hmacMD5(ntowf, proof)
+	var encryptedKey []byte
+	if this.flags&ntlmKeyExch != 0 {
+		exported := make([]byte, 16)
+		if _, err := rand.Read(exported); err != nil {
+			return nil, err
+		}
+		encryptedKey = make([]byte, 16)
+		cipher, _ := rc4.NewCipher(sessionKey)
+		cipher.XORKeyStream(encryptedKey, exported)
+		sessionKey = exported
+	}
+	this.deriveKeys(sessionKey)
+
+	// Now lay out the message, the fields point at the payload after the 64 byte header
+	payload := [][]byte{lmResponse, ntResponse, toUnicode(this.domain), toUnicode(this.user), nil, encryptedKey}
+	msg := make([]byte, 64)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 3)
+	offset := len(msg)
+	for i, data := range payload {
+		binary.LittleEndian.PutUint16(msg[12+i*8:], uint16(len(data)))
+		binary.LittleEndian.PutUint16(msg[14+i*8:], uint16(len(data)))
+		binary.LittleEndian.PutUint32(msg[16+i*8:], uint32(offset))
+		offset += len(data)
+	}
+	binary.LittleEndian.PutUint32(msg[60:], this.flags)
+	for _, data := range payload {
+		msg = append(msg, data...)
+	}
+
+	return msg, nil
+}
+
+// Works out the client signing and sealing keys from the session key
+func (this *ntlmClient) deriveKeys(sessionKey []byte) {
+	sign := md5.Sum(append(append([]byte{}, sessionKey...), "session key to client-to-server signing key magic constant\x00"...))
+	seal := md5.Sum(append(append([]byte{}, sessionKey...), "session key to client-to-server sealing key magic constant\x00"...))
+	this.signingKey = sign[:]
+	this.sealer, _ = rc4.NewCipher(seal[:])
+}
+
+// Encrypts a message and returns it with its signature on the front, which is
+// the way CredSSP wants it.
+func (this *ntlmClient) seal(msg []byte) []byte {
+	seq := make([]byte, 4)
+	binary.LittleEndian.PutUint32(seq, this.seq)
+	this.seq++
+
+	sealed := make([]byte, len(msg))
+	this.sealer.XORKeyStream(sealed, msg)
+
+	checksum := hmacMD5(this.signingKey, seq, msg)[:8]
+	if this.flags&ntlmKeyExch != 0 {
+		this.sealer.XORKeyStream(checksum, checksum)
+	}
+
+	signature := bytes.Join([][]byte{{1, 0, 0, 0}, checksum, seq}, nil)
+	return append(signature, sealed...)
+}
+
+// Returns a string from the server's target info, like its name or domain
+func (this *ntlmClient) targetString(id uint16) string {
+	value, ok := this.targetInfo[id]
+	if !ok {
+		return ""
+	}
+	return fromUnicode(value)
+}
+
+// Reads a length/offset field from a message and returns what it points at
+func (this *ntlmClient) field(msg []byte, at int) ([]byte, error) {
+	length := int(binary.LittleEndian.Uint16(msg[at:]))
+	offset := int(binary.LittleEndian.Uint32(msg[at+4:]))
+	if offset+length > len(msg) {
+		return nil, errors.New("Invalid NTLM message")
+	}
+	return msg[offset : offset+length], nil
+}
+
+// Splits up the AV pairs in the target info
+func (this *ntlmClient) parseAVPairs(info []byte) map[uint16][]byte {
+	pairs := map[uint16][]byte{}
+	for len(info) >= 4 {
+		id := binary.LittleEndian.Uint16(info)
+		length := int(binary.LittleEndian.Uint16(info[2:]))
+		if id == avEOL || 4+length > len(info) {
+			break
+		}
+		pairs[id] = info[4 : 4+length]
+		info = info[4+length:]
+	}
+	return pairs
+}
+
+// HMAC-MD5 over everything we're given
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(md5.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+// Turns a string into the UTF-16LE NTLM wants
+func toUnicode(s string) []byte {
+	chars := utf16.Encode([]rune(s))
+	b := make([]byte, len(chars)*2)
+	for i, c := range chars {
+		binary.LittleEndian.PutUint16(b[i*2:], c)
+	}
+	return b
+}
+
+// Turns UTF-16LE from the server back into a string
+func fromUnicode(b []byte) string {
+	chars := make([]uint16, len(b)/2)
+	for i := range chars {
+		chars[i] = binary.LittleEndian.Uint16(b[i*2:])
+	}
+	return string(utf16.Decode(chars))
+}
@@ -0,0 +1,170 @@
+package rdp
+
+import (
+	"bytes"
+	"crypto/rc4"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+// The known values below are from the NTLMv2 examples in MS-NLMP section 4.2.4
+func unhex(s string) []byte {
+	b, _ := hex.DecodeString(s)
+	return b
+}
+
+// Builds a challenge from a server called Server in the Domain domain, with a time if
+// we're given one
+func testChallenge(flags uint32, timestamp []byte) []byte {
+	targetInfo := bytes.Join([][]byte{
+		{avNbDomainName, 0, 12, 0}, toUnicode("Domain"),
+		{avNbComputerName, 0, 12, 0}, toUnicode("Server"),
+	}, nil)
+	if timestamp != nil {
+		targetInfo = append(append(targetInfo, avTimestamp, 0, 8, 0), timestamp...)
+	}
+	targetInfo = append(targetInfo, 0, 0, 0, 0)
+
+	msg := make([]byte, 48)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 2)
+	binary.LittleEndian.PutUint32(msg[20:], flags)
+	copy(msg[24:], unhex("0123456789abcdef"))
+	binary.LittleEndian.PutUint16(msg[40:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint16(msg[42:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint32(msg[44:], 48)
+	return append(msg, targetInfo...)
+}
+
+// Reads a field out of a message we built, failing the test if it's not there
+func testField(t *testing.T, msg []byte, at int) []byte {
+	value, err := (&ntlmClient{}).field(msg, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestNTOWFv2(t *testing.T) {
+	client := newNTLMClient("Domain", "User", "Password")
+	if !bytes.Equal(client.ntHash, unhex("a4f49c406510bdcab6824ee7c30fd852")) {
+		t.Errorf("got NT hash %x", client.ntHash)
+	}
+	if ntowf := hmacMD5(client.ntHash, toUnicode("USERDomain")); !bytes.Equal(ntowf, unhex("0c868a403bfd7a93a3001ef22ef02e3f")) {
+		t.Errorf("got NTOWFv2 %x", ntowf)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	for _, timestamp := range [][]byte{nil, make([]byte, 8)} {
+		client := newNTLMClient("Domain", "User", "Password")
+		challenge := testChallenge(ntlmDefaultFlags, timestamp)
+		msg, err := client.authenticate(challenge)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(msg[:8], ntlmSignature) || binary.LittleEndian.Uint32(msg[8:]) != 3 {
+			t.Fatal("not an AUTHENTICATE message")
+		}
+		if domain := fromUnicode(testField(t, msg, 28)); domain != "Domain" {
+			t.Errorf("got domain %q", domain)
+		}
+		if user := fromUnicode(testField(t, msg, 36)); user != "User" {
+			t.Errorf("got user %q", user)
+		}
+
+		// The proof has to check out against the rest of the response, and the response
+		// has to carry the target info the server sent
+		ntowf := unhex("0c868a403bfd7a93a3001ef22ef02e3f")
+		ntResponse := testField(t, msg, 20)
+		proof := ntResponse[:16]
+		if !bytes.Equal(hmacMD5(ntowf, unhex("0123456789abcdef"), ntResponse[16:]), proof) {
+			t.Error("NTLMv2 proof doesn't match the response")
+		}
+		if !bytes.Contains(ntResponse, testField(t, challenge, 40)) {
+			t.Error("target info is missing from the response")
+		}
+		clientChallenge := ntResponse[32:40]
+
+		// With a time from the server the LM response is empty, without one it's LMv2
+		lmResponse := testField(t, msg, 12)
+		if timestamp != nil {
+			if !bytes.Equal(ntResponse[24:32], timestamp) {
+				t.Error("didn't use the server's time")
+			}
+			if !bytes.Equal(lmResponse, make([]byte, 24)) {
+				t.Errorf("got LM response %x, want zeros", lmResponse)
+			}
+		} else if !bytes.Equal(lmResponse, append(hmacMD5(ntowf, unhex("0123456789abcdef"), clientChallenge), clientChallenge...)) {
+			t.Errorf("got LM response %x, want LMv2", lmResponse)
+		}
+
+		// The exchanged key comes out of the encrypted one with the session base key,
+		// and it's the one the client seals with
+		encryptedKey := testField(t, msg, 52)
+		exported := make([]byte, 16)
+		cipher, _ := rc4.NewCipher(hmacMD5(ntowf, proof))
+		cipher.XORKeyStream(exported, encryptedKey)
+
+		server := &ntlmClient{flags: client.flags}
+		server.deriveKeys(exported)
+		if !bytes.Equal(client.seal([]byte("hello")), server.seal([]byte("hello"))) {
+			t.Error("client isn't sealing with the key it sent")
+		}
+	}
+}
+
+func TestSeal(t *testing.T) {
+	client := &ntlmClient{flags: ntlmDefaultFlags}
+	client.deriveKeys(unhex("55555555555555555555555555555555"))
+
+	if !bytes.Equal(client.signingKey, unhex("4788dc861b4782f35d43fd98fe1a2d39")) {
+		t.Errorf("got signing key %x", client.signingKey)
+	}
+
+	sealed := client.seal(toUnicode("Plaintext"))
+	want := unhex("010000007fb38ec5c55d497600000000" + "54e50165bf1936dc996020c1811b0f06fb5f")
+	if !bytes.Equal(sealed, want) {
+		t.Errorf("got %x, want %x", sealed, want)
+	}
+
+	// Each message after that gets the next sequence number
+	if seq := binary.LittleEndian.Uint32(client.seal([]byte("x"))[12:]); seq != 1 {
+		t.Errorf("got sequence number %d, want 1", seq)
+	}
+}
+
+func TestAuthenticateInvalid(t *testing.T) {
+	client := newNTLMClient("Domain", "User", "Password")
+	if _, err := client.authenticate(client.negotiate()); err == nil {
+		t.Error("negotiate message was accepted as a challenge")
+	}
+
+	// A target info field pointing past the end of the message
+	challenge := testChallenge(ntlmDefaultFlags, nil)
+	binary.LittleEndian.PutUint32(challenge[44:], 1000)
+	if _, err := client.authenticate(challenge); err == nil {
+		t.Error("challenge with a bad target info field was accepted")
+	}
+}
+
+func TestParseAVPairs(t *testing.T) {
+	client := &ntlmClient{}
+	client.targetInfo = client.parseAVPairs(testField(t, testChallenge(0, nil), 40))
+	if name := client.targetString(avNbComputerName); name != "Server" {
+		t.Errorf("got computer name %q", name)
+	}
+	if domain := client.targetString(avNbDomainName); domain != "Domain" {
+		t.Errorf("got domain %q", domain)
+	}
+	if dns := client.targetString(avDnsDomainName); dns != "" {
+		t.Errorf("got DNS domain %q for a pair that isn't there", dns)
+	}
+
+	// A pair running off the end stops the parse rather than reading past it
+	if pairs := client.parseAVPairs([]byte{avNbComputerName, 0, 50, 0, 'a', 0}); len(pairs) != 0 {
+		t.Errorf("got %v from a truncated pair", pairs)
+	}
+}
@@ -0,0 +1,419 @@
+package rdp
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/emperorcow/go-netscan/scanners"
+)
+
+// The security protocols we can ask for in the X.224 connection request
+const (
+	protocolRDP    = 0x0
+	protocolSSL    = 0x1
+	protocolHybrid = 0x2
+)
+
+// The types of negotiation data that come back in the connection confirm
+const (
+	negResponse = 0x02
+	negFailure  = 0x03
+)
+
+// The failure code the server uses when it won't talk to us without NLA
+const hybridRequiredByServer = 0x5
+
+// The CredSSP version we speak.  From version 5 on the public key is hashed with a
+// nonce instead of being sent back as is.
+const credSSPVersion = 6
+
+// The biggest CredSSP message we'll read.  Ours are a few KB, so a length past this
+// isn't one and we don't want to allocate for it.
+const maxCredSSPSize = 1 << 16
+
+// The status Windows gives when the account isn't granted the type of logon asked
+// for, which for us means RDP
+const statusLogonTypeNotGranted = 0xc000015b
+
+// A CredSSP message, both directions use the same one
+type tsRequest struct {
+	Version     int         `asn1:"explicit,tag:0"`
+	NegoTokens  []negoToken `asn1:"optional,explicit,tag:1"`
+	AuthInfo    []byte      `asn1:"optional,explicit,tag:2"`
+	PubKeyAuth  []byte      `asn1:"optional,explicit,tag:3"`
+	ErrorCode   int         `asn1:"optional,explicit,default:0,tag:4"`
+	ClientNonce []byte      `asn1:"optional,explicit,tag:5"`
+}
+
+// A single SPNEGO/NTLM token inside a CredSSP message
+type negoToken struct {
+	Token []byte `asn1:"explicit,tag:0"`
+}
+
+// This is our scanner and does all the work from the main
+type Scanner struct{}
+
+// Returns the name of this scanner
+func (this Scanner) Name() string {
+	return "rdp"
+}
+
+// Returns a description of this scanner
+func (this Scanner) Description() string {
+	return "Remote Desktop Protocol (RDP) with NLA"
+}
+
+// Returns the types of auth we support in this scanner
+func (this Scanner) SupportedAuthentication() []string {
+	return []string{"basic"}
+}
+
+// Returns some examples on how to configure the auth info
+func (this Scanner) SupportedAuthenticationExample() map[string]string {
+	return map[string]string{
+		"basic": "USERNAME,PASSWORD or DOMAIN\\USERNAME,PASSWORD",
+	}
+}
+
+// Runs the actual scan, takes an input of our target, the creds we need to use for this one,
+// a command to run if we have one, and our out channel for results.  We stop once NLA has
+// checked the credentials, so there's no desktop to run a command on.
+func (this Scanner) Scan(target, cmd string, cred scanners.Credential, outChan chan scanners.Result) {
+	// Check our target and see if the default port is there, if not we include it.
+	if !strings.Contains(target, ":") {
+		target = target + ":3389"
+	}
+
+	var domain, user string
+
+	// Check and see if we have a logon domain in our user (DOMAIN\USER)
+	if strings.Contains(cred.Account, "\\") {
+		logonInfo := strings.Split(cred.Account, "\\")
+		domain = logonInfo[0]
+		user = logonInfo[1]
+	} else {
+		user = cred.Account
+	}
+
+	// Let's assume that we connected successfully and declare the data as such, we can edit it later if we failed
+	result := scanners.Result{
+		Host:    target,
+		Auth:    cred,
+		Message: "Successfully connected",
+		Status:  true,
+		Output:  "",
+		Info:    map[string]string{},
+	}
+
+	// First see if the server will let us in without NLA, which is worth knowing on
+	// its own.  If it won't even talk to us, there's no point going further.
+	required, err := this.nlaRequired(target)
+	if err != nil {
+		result.Message = err.Error()
+		result.Status = false
+		outChan <- result
+		return
+	}
+	if required {
+		result.Info["nla"] = "required"
+	} else {
+		result.Info["nla"] = "not required"
+	}
+
+	// Depending on the authentication type, run the correct connection function
+	switch cred.Type {
+	case "basic":
+		err = this.checkCredentials(target, domain, user, cred.AuthData, result.Info)
+	}
+
+	// If we got an error, let's set the data properly
+	if err != nil {
+		result.Message, result.Status = this.classifyError(err)
+	}
+
+	// Finally, let's pass our result to the proper channel to write out to the user
+	outChan <- result
+}
+
+// Asks the server for plain TLS security, which it will turn down if it requires NLA
+func (this Scanner) nlaRequired(host string) (bool, error) {
+	conn, err := scanners.Dial("tcp", host)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	// Any other refusal (like no TLS at all) still means NLA isn't what it's after
+	_, err = this.negotiate(conn, protocolSSL)
+	if failure, ok := err.(negotiationFailure); ok {
+		return failure == hybridRequiredByServer, nil
+	}
+	return false, err
+}
+
+// Connects and runs through CredSSP with NTLM up to the point where the server has
+// checked our credentials.  We never send the credentials themselves, so no session
+// gets created on the other end.
+func (this Scanner) checkCredentials(host, domain, user, pass string, info map[string]string) error {
+	conn, err := scanners.Dial("tcp", host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	selected, err := this.negotiate(conn, protocolSSL|protocolHybrid)
+	if err != nil {
+		return err
+	}
+	if selected != protocolHybrid {
+		info["nla"] = "not supported"
+		return errors.New("Server doesn't support NLA, credentials can't be checked without a full logon")
+	}
+
+	// Everything from here is inside TLS, and CredSSP ties itself to the server's key
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return errors.New("Server didn't send a certificate")
+	}
+	info["certificate"] = certs[0].Subject.CommonName
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(certs[0].RawSubjectPublicKeyInfo, &spki); err != nil {
+		return err
+	}
+	pubKey := spki.PublicKey.Bytes
+
+	// Start NTLM and get the challenge back
+	client := newNTLMClient(domain, user, pass)
+	reply, err := this.exchange(tlsConn, tsRequest{
+		Version:    credSSPVersion,
+		NegoTokens: []negoToken{{Token: client.negotiate()}},
+	})
+	if err != nil {
+		return err
+	}
+	if len(reply.NegoTokens) == 0 {
+		return errors.New("Server didn't send an NTLM challenge")
+	}
+
+	auth, err := client.authenticate(reply.NegoTokens[0].Token)
+	if err != nil {
+		return err
+	}
+	if name := client.targetString(avDnsComputerName); name != "" {
+		info["hostname"] = name
+	} else if name := client.targetString(avNbComputerName); name != "" {
+		info["hostname"] = name
+	}
+	if name := client.targetString(avDnsDomainName); name != "" {
+		info["domain"] = name
+	} else if name := client.targetString(avNbDomainName); name != "" {
+		info["domain"] = name
+	}
+
+	// Send our answer along with proof that we're talking to the server we think we
+	// are.  Newer servers want a hash of the key, older ones want the key itself.
+	request := tsRequest{
+		Version:    credSSPVersion,
+		NegoTokens: []negoToken{{Token: auth}},
+	}
+	if reply.Version >= 5 {
+		request.ClientNonce = make([]byte, 32)
+		if _, err := rand.Read(request.ClientNonce); err != nil {
+			return err
+		}
+		hash := sha256.New()
+		hash.Write([]byte("CredSSP Client-To-Server Binding Hash\x00"))
+		hash.Write(request.ClientNonce)
+		hash.Write(pubKey)
+		request.PubKeyAuth = client.seal(hash.Sum(nil))
+	} else {
+		request.PubKeyAuth = client.seal(pubKey)
+	}
+
+	// If the credentials are good the server answers with its own proof, if they're
+	// not it either tells us why or hangs up on us.
+	reply, err = this.exchange(tlsConn, request)
+	if err != nil {
+		if err == io.EOF || strings.Contains(err.Error(), "connection reset") {
+			return errors.New("Logon failed")
+		}
+		return err
+	}
+	if len(reply.PubKeyAuth) == 0 {
+		return errors.New("Logon failed")
+	}
+	return nil
+}
+
+// Sends the X.224 connection request asking for the protocols we were given, and
+// returns the one the server picked.
+func (this Scanner) negotiate(conn net.Conn, protocols uint32) (uint32, error) {
+	// TPKT header, X.224 connection request, then the RDP negotiation request
+	request := []byte{
+		0x03, 0x00, 0x00, 0x13,
+		0x0e, 0xe0, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x01, 0x00, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}
+	binary.LittleEndian.PutUint32(request[15:], protocols)
+	if _, err := conn.Write(request); err != nil {
+		return 0, err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return 0, err
+	}
+	if header[0] != 0x03 {
+		return 0, errors.New("Not an RDP server")
+	}
+	length := int(binary.BigEndian.Uint16(header[2:]))
+	if length < 11 {
+		return 0, errors.New("Invalid connection confirm from server")
+	}
+	confirm := make([]byte, length-4)
+	if _, err := io.ReadFull(conn, confirm); err != nil {
+		return 0, err
+	}
+	if confirm[1]&0xf0 != 0xd0 {
+		return 0, errors.New("Server refused the connection")
+	}
+
+	// Servers too old to know about negotiation only do standard RDP security
+	if len(confirm) < 15 {
+		return protocolRDP, nil
+	}
+	value := binary.LittleEndian.Uint32(confirm[11:])
+	switch confirm[7] {
+	case negResponse:
+		return value, nil
+	case negFailure:
+		return 0, negotiationFailure(value)
+	default:
+		return 0, errors.New("Invalid connection confirm from server")
+	}
+}
+
+// Sends a CredSSP message and reads the one that comes back
+func (this Scanner) exchange(conn net.Conn, request tsRequest) (tsRequest, error) {
+	var reply tsRequest
+
+	b, err := asn1.Marshal(request)
+	if err != nil {
+		return reply, err
+	}
+	if _, err := conn.Write(b); err != nil {
+		return reply, err
+	}
+
+	b, err = this.readDER(conn)
+	if err != nil {
+		return reply, err
+	}
+	if _, err := asn1.Unmarshal(b, &reply); err != nil {
+		return reply, err
+	}
+	if reply.ErrorCode != 0 {
+		return reply, ntStatus(uint32(reply.ErrorCode))
+	}
+	return reply, nil
+}
+
+// Reads a single DER encoded value off the connection, working out its length from
+// the header so we know when to stop.
+func (this Scanner) readDER(conn net.Conn) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+
+	length := int(header[1])
+	if length&0x80 != 0 {
+		size := make([]byte, length&0x7f)
+		if len(size) == 0 || len(size) > 4 {
+			return nil, errors.New("Invalid CredSSP message")
+		}
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return nil, err
+		}
+		header = append(header, size...)
+		length = 0
+		for _, b := range size {
+			length = length<<8 | int(b)
+		}
+	}
+
+	if length > maxCredSSPSize {
+		return nil, errors.New("Invalid CredSSP message")
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return nil, err
+	}
+	return append(header, body...), nil
+}
+
+// Takes an error from the scan and turns it into something that tells the user what
+// happened, along with whether the credentials were still good.
+func (this Scanner) classifyError(err error) (string, bool) {
+	switch e := err.(type) {
+	case ntStatus:
+		if e == statusLogonTypeNotGranted {
+			return "Valid credentials, but not allowed to log on over RDP", true
+		}
+		if message, valid, ok := scanners.NTStatusMessage(uint32(e)); ok {
+			return message, valid
+		}
+	case negotiationFailure:
+		return e.Error(), false
+	}
+	return err.Error(), false
+}
+
+// An NTSTATUS code the server sent back in a CredSSP message
+type ntStatus uint32
+
+func (this ntStatus) Error() string {
+	return fmt.Sprintf("Logon failed with status 0x%08x", uint32(this))
+}
+
+// A failure code the server sent back instead of picking a protocol
+type negotiationFailure uint32
+
+func (this negotiationFailure) Error() string {
+	switch this {
+	case 0x1:
+		return "Server requires TLS"
+	case 0x2:
+		return "Server doesn't allow TLS"
+	case 0x3:
+		return "Server has no certificate for TLS"
+	case hybridRequiredByServer:
+		return "Server requires NLA"
+	default:
+		return fmt.Sprintf("Negotiation failed with code %d", uint32(this))
+	}
+}
+
+// Creates a new scanner for us to add to the main loop
+func NewScanner() scanners.Scanner {
+	return &Scanner{}
+}
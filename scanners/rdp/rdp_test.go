@@ -0,0 +1,148 @@
+package rdp
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"io"
+	"net"
+	"testing"
+)
+
+// Runs a server on the other end of a pipe and hands back our end
+func fakeServer(t *testing.T, serve func(conn net.Conn)) net.Conn {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go func() {
+		defer server.Close()
+		serve(server)
+	}()
+	return client
+}
+
+// A connection confirm with the negotiation data we're given, or none at all
+func connectionConfirm(negType byte, value uint32) []byte {
+	if negType == 0 {
+		return []byte{0x03, 0x00, 0x00, 0x0b, 0x06, 0xd0, 0x00, 0x00, 0x12, 0x34, 0x00}
+	}
+	return []byte{
+		0x03, 0x00, 0x00, 0x13,
+		0x0e, 0xd0, 0x00, 0x00, 0x12, 0x34, 0x00,
+		negType, 0x00, 0x08, 0x00, byte(value), byte(value >> 8), byte(value >> 16), byte(value >> 24),
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name     string
+		reply    []byte
+		selected uint32
+		err      string
+	}{
+		{"nla", connectionConfirm(negResponse, protocolHybrid), protocolHybrid, ""},
+		{"tls only", connectionConfirm(negResponse, protocolSSL), protocolSSL, ""},
+		{"old server", connectionConfirm(0, 0), protocolRDP, ""},
+		{"needs nla", connectionConfirm(negFailure, hybridRequiredByServer), 0, "Server requires NLA"},
+		{"not rdp", []byte("HTTP/1.1 400 Bad Request\r\n\r\n"), 0, "Not an RDP server"},
+	}
+
+	for _, test := range tests {
+		var request []byte
+		conn := fakeServer(t, func(conn net.Conn) {
+			request = make([]byte, 19)
+			io.ReadFull(conn, request)
+			conn.Write(test.reply)
+		})
+
+		selected, err := Scanner{}.negotiate(conn, protocolSSL|protocolHybrid)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if selected != test.selected || got != test.err {
+			t.Errorf("%s: got %d %q, want %d %q", test.name, selected, got, test.selected, test.err)
+		}
+		if request[15] != protocolSSL|protocolHybrid {
+			t.Errorf("%s: asked for protocols %d", test.name, request[15])
+		}
+	}
+}
+
+func TestExchange(t *testing.T) {
+	// Big enough that the length takes more than one byte
+	token := bytes.Repeat([]byte{0xab}, 300)
+
+	conn := fakeServer(t, func(conn net.Conn) {
+		b, err := Scanner{}.readDER(conn)
+		if err != nil {
+			return
+		}
+		var request tsRequest
+		asn1.Unmarshal(b, &request)
+		reply, _ := asn1.Marshal(tsRequest{Version: request.Version, NegoTokens: []negoToken{{Token: token}}})
+		conn.Write(reply)
+	})
+
+	reply, err := Scanner{}.exchange(conn, tsRequest{Version: credSSPVersion, NegoTokens: []negoToken{{Token: []byte("hi")}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Version != credSSPVersion || len(reply.NegoTokens) != 1 || !bytes.Equal(reply.NegoTokens[0].Token, token) {
+		t.Errorf("got %+v", reply)
+	}
+}
+
+func TestExchangeError(t *testing.T) {
+	// Windows sends the status as a signed number, so it comes through negative, but
+	// it's the same code either way
+	for _, code := range []int{0xc000006a, int(int32(-0x3fffff96))} {
+		conn := fakeServer(t, func(conn net.Conn) {
+			if _, err := (Scanner{}).readDER(conn); err != nil {
+				return
+			}
+			reply, _ := asn1.Marshal(tsRequest{Version: credSSPVersion, ErrorCode: code})
+			conn.Write(reply)
+		})
+
+		_, err := Scanner{}.exchange(conn, tsRequest{Version: credSSPVersion})
+		if message, valid := (Scanner{}).classifyError(err); message != "Invalid password" || valid {
+			t.Errorf("code %d: got %q %v", code, message, valid)
+		}
+	}
+}
+
+func TestReadDERInvalid(t *testing.T) {
+	// An indefinite length isn't allowed in DER
+	conn := fakeServer(t, func(conn net.Conn) {
+		conn.Write([]byte{0x30, 0x80, 0x00, 0x00})
+	})
+	if _, err := (Scanner{}).readDER(conn); err == nil || err.Error() != "Invalid CredSSP message" {
+		t.Errorf("got %v", err)
+	}
+
+	// And a length that would have us allocate gigabytes
+	conn = fakeServer(t, func(conn net.Conn) {
+		conn.Write([]byte{0x30, 0x84, 0x7f, 0xff, 0xff, 0xff})
+	})
+	if _, err := (Scanner{}).readDER(conn); err == nil || err.Error() != "Invalid CredSSP message" {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err     error
+		message string
+		valid   bool
+	}{
+		{ntStatus(0xc0000071), "Valid credentials, but the password has expired", true},
+		{ntStatus(0xc0000234), "Account locked out", false},
+		{ntStatus(0xc000015b), "Valid credentials, but not allowed to log on over RDP", true},
+		{ntStatus(0xc0000001), "Logon failed with status 0xc0000001", false},
+		{negotiationFailure(0x3), "Server has no certificate for TLS", false},
+	}
+	for _, test := range tests {
+		if message, valid := (Scanner{}).classifyError(test.err); message != test.message || valid != test.valid {
+			t.Errorf("%v: got %q %v", test.err, message, valid)
+		}
+	}
+}
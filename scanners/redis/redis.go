@@ -0,0 +1,193 @@
+package redis
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emperorcow/go-netscan/scanners"
+	"github.com/gomodule/redigo/redis"
+)
+
+// This is our scanner and does all the work from the main
+type Scanner struct {
+	useTLS bool // Whether we should use TLS on our connections
+}
+
+// Returns the name of this scanner
+func (this Scanner) Name() string {
+	return "redis"
+}
+
+// Returns a description of this scanner
+func (this Scanner) Description() string {
+	return "Redis Key-Value Store"
+}
+
+// Returns the types of auth we support in this scanner
+func (this Scanner) SupportedAuthentication() []string {
+	return []string{"basic", "acl"}
+}
+
+// Returns some examples on how to configure the auth info
+func (this Scanner) SupportedAuthenticationExample() map[string]string {
+	return map[string]string{
+		"basic": "PASSWORD",
+		"acl":   "USERNAME,PASSWORD",
+	}
+}
+
+// Adds our flags to the command line
+func (this *Scanner) RegisterFlags(flags *flag.FlagSet) {
+	flags.BoolVar(&this.useTLS, "redis-tls", false, "Use TLS when connecting to Redis servers. Certificates are not verified.")
+}
+
+// Runs the actual scan, takes an input of our target, the creds we need to use for this one,
+// a command to run if we have one, and our out channel for results
+func (this Scanner) Scan(target, cmd string, cred scanners.Credential, outChan chan scanners.Result) {
+	// Check our target and see if the default port is there, if not we include it.
+	if !strings.Contains(target, ":") {
+		target = target + ":6379"
+	}
+
+	// Let's assume that we connected successfully and declare the data as such, we can edit it later if we failed
+	result := scanners.Result{
+		Host:    target,
+		Auth:    cred,
+		Message: "Successfully connected",
+		Status:  true,
+		Output:  "",
+		Info:    map[string]string{},
+	}
+
+	conn, err := redis.Dial("tcp", target,
+		redis.DialContextFunc(scanners.DialContext),
+		redis.DialReadTimeout(10*time.Second),
+		redis.DialWriteTimeout(10*time.Second),
+		redis.DialUseTLS(this.useTLS),
+		redis.DialTLSSkipVerify(true),
+	)
+	if err != nil {
+		result.Message = err.Error()
+		result.Status = false
+		outChan <- result
+		return
+	}
+	defer conn.Close()
+
+	// Before we log in, let's see if we even need to.  If we can PING without
+	// authenticating, anyone can get in.
+	_, err = conn.Do("PING")
+	unauthenticated := err == nil
+	result.Info["unauthenticated"] = strconv.FormatBool(unauthenticated)
+
+	// Depending on the authentication type, run the correct AUTH command
+	switch cred.Type {
+	case "basic":
+		// The legacy AUTH only takes the password
+		_, err = conn.Do("AUTH", cred.AuthData)
+	case "acl":
+		// Redis 6 and up can take a username as well
+		_, err = conn.Do("AUTH", cred.Account, cred.AuthData)
+	}
+
+	// If we got an error, let's set the data properly.  If the server told us it
+	// doesn't have a password set, we're still in, so we'll call that a success.
+	if err != nil {
+		noPassword := strings.Contains(err.Error(), "without any password configured") ||
+			strings.Contains(err.Error(), "no password is set")
+		if unauthenticated && noPassword {
+			result.Message = "No authentication required"
+			err = nil
+		} else {
+			result.Message = err.Error()
+			result.Status = false
+		}
+	}
+
+	// If we made it in, let's grab the version while we're here
+	if err == nil {
+		if info, infoErr := redis.String(conn.Do("INFO", "server")); infoErr == nil {
+			result.Info["version"] = this.infoField(info, "redis_version")
+		}
+	}
+
+	// If we didn't get an error and we have a command to run, let's do it.
+	if err == nil && cmd != "" {
+		// Execute the command
+		result.Output, err = this.executeCommand(conn, cmd)
+		if err != nil {
+			// If we got an error, let's give the user some output.
+			result.Output = "Command Error: " + err.Error()
+		}
+	}
+
+	// Finally, let's pass our result to the proper channel to write out to the user
+	outChan <- result
+}
+
+// Runs a command on an existing connection and then returns the reply as a string.
+// The command is split on spaces, so "INFO server" will send INFO with one argument.
+func (this Scanner) executeCommand(conn redis.Conn, cmd string) (string, error) {
+	fields := strings.Fields(cmd)
+	if len(fields) == 0 {
+		return "", nil
+	}
+
+	args := make([]interface{}, len(fields)-1)
+	for i, field := range fields[1:] {
+		args[i] = field
+	}
+
+	reply, err := conn.Do(fields[0], args...)
+	if err != nil {
+		return "", err
+	}
+
+	return this.formatReply(reply, ""), nil
+}
+
+// Turns a reply from the server into text, the same way redis-cli shows it.  Arrays
+// get numbered and nested arrays are indented.
+func (this Scanner) formatReply(reply interface{}, indent string) string {
+	switch reply := reply.(type) {
+	case nil:
+		return "(nil)"
+	case []byte:
+		return string(reply)
+	case string:
+		return reply
+	case int64:
+		return "(integer) " + strconv.FormatInt(reply, 10)
+	case redis.Error:
+		return "(error) " + reply.Error()
+	case []interface{}:
+		if len(reply) == 0 {
+			return "(empty array)"
+		}
+		lines := make([]string, len(reply))
+		for i, item := range reply {
+			lines[i] = fmt.Sprintf("%s%d) %s", indent, i+1, this.formatReply(item, indent+"   "))
+		}
+		return strings.TrimPrefix(strings.Join(lines, "\n"), indent)
+	default:
+		return fmt.Sprint(reply)
+	}
+}
+
+// Pulls a single field out of the text that INFO gives us back
+func (this Scanner) infoField(info, field string) string {
+	for _, line := range strings.Split(info, "\n") {
+		if strings.HasPrefix(line, field+":") {
+			return strings.TrimSpace(strings.TrimPrefix(line, field+":"))
+		}
+	}
+	return ""
+}
+
+// Creates a new scanner for us to add to the main loop
+func NewScanner() scanners.Scanner {
+	return &Scanner{}
+}
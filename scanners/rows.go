@@ -0,0 +1,50 @@
+package scanners
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// Takes the rows from a SQL query and turns them into a tab separated table with
+// a header row of column names.  Used by the database scanners to give the user
+// the output of whatever they ran with -c.
+func FormatRows(rows *sql.Rows) (string, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return "", err
+	}
+
+	// Start with our header row
+	lines := []string{strings.Join(columns, "\t")}
+
+	// We don't know the types ahead of time, so we'll scan everything into raw bytes
+	// which every driver can give us, and NULLs will just come back as nil.
+	values := make([]sql.RawBytes, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return "", err
+		}
+
+		fields := make([]string, len(values))
+		for i, value := range values {
+			if value == nil {
+				fields[i] = "NULL"
+			} else {
+				fields[i] = string(value)
+			}
+		}
+		lines = append(lines, strings.Join(fields, "\t"))
+	}
+
+	// If there are any errors from looping through the rows, we'll return them
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
@@ -1,13 +1,30 @@
 package smb
 
 import (
-	"strconv"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
 	"strings"
+	"time"
+	"unicode/utf16"
 
 	"github.com/emperorcow/go-netscan/scanners"
-	"github.com/stacktitan/smb/smb"
+	"github.com/hirochachacha/go-smb2"
 )
 
+// Shares that only an administrator can get into, if we can mount any of these
+// we're a local admin on the box.
+var adminShares = map[string]bool{
+	"ADMIN$": true,
+	"C$":     true,
+}
+
+// The longest command line cmd.exe will run
+const maxCommandLine = 8191
+
 // This is our scanner and does all the work from the main
 type Scanner struct{}
 
@@ -23,39 +40,36 @@ func (this Scanner) Description() string {
 
 // Returns the types of auth we support in this scanner
 func (this Scanner) SupportedAuthentication() []string {
-	return []string{"basic"}
+	return []string{"basic", "ntlmhash"}
 }
 
 // Returns some examples on how to configure the auth info
 func (this Scanner) SupportedAuthenticationExample() map[string]string {
 	return map[string]string{
-		"basic": "USERNAME,PASSWORD",
+		"basic":    "USERNAME,PASSWORD or DOMAIN\\USERNAME,PASSWORD",
+		"ntlmhash": "DOMAIN\\USERNAME,LMHASH:NTHASH (pass-the-hash, the LM hash can be left empty)",
 	}
 }
 
 // Runs the actual scan, takes an input of our target, the creds we need to use for this one,
-// a command to run if we have one, and our out channel for results
+// a command to run if we have one, and our out channel for results.  Once we're logged in
+// we list the shares and check what we can do with each, then run the command as a service.
 func (this Scanner) Scan(target, cmd string, cred scanners.Credential, outChan chan scanners.Result) {
-	opts := smb.Options{
-		Host:     target,
-		Port:     445,
-		User:     cred.Account,
-		Domain:   ".",
-		Password: cred.AuthData,
+	// Check our target and see if the default port is there, if not we include it.
+	if !strings.Contains(target, ":") {
+		target = target + ":445"
 	}
 
-	// Check our target and see if it contains a port, if so parse it out
-	if strings.Contains(target, ":") {
-		targetInfo := strings.Split(target, ":")
-		opts.Host = targetInfo[0]
-		opts.Port, _ = strconv.Atoi(targetInfo[1])
+	initiator := &smb2.NTLMInitiator{
+		User:   cred.Account,
+		Domain: ".",
 	}
 
 	// Check and see if we have a logon domain in our user (DOMAIN\USER)
 	if strings.Contains(cred.Account, "\\") {
 		logonInfo := strings.Split(cred.Account, "\\")
-		opts.Domain = logonInfo[0]
-		opts.User = logonInfo[1]
+		initiator.Domain = logonInfo[0]
+		initiator.User = logonInfo[1]
 	}
 
 	// Let's assume that we connected successfully and declare the data as such, we can edit it later if we failed
@@ -65,26 +79,279 @@ func (this Scanner) Scan(target, cmd string, cred scanners.Credential, outChan c
 		Message: "Successfully connected",
 		Status:  true,
 		Output:  "",
+		Info:    map[string]string{},
+	}
+
+	// Depending on the authentication type, give the session a password or a hash
+	var err error
+	switch cred.Type {
+	case "basic":
+		initiator.Password = cred.AuthData
+	case "ntlmhash":
+		var hash string
+		if hash, err = scanners.NTHash(cred.AuthData); err == nil {
+			initiator.Hash, err = hex.DecodeString(hash)
+		}
+	}
+
+	var conn net.Conn
+	var session *smb2.Session
+	if err == nil {
+		conn, session, err = this.connect(target, initiator)
+	}
+
+	// If we got an error, let's set the data properly
+	if err != nil {
+		result.Message, result.Status = this.classifyError(err)
+		outChan <- result
+		return
 	}
+	defer conn.Close()
+	defer session.Logoff()
 
-	session, err := smb.NewSession(opts, false)
-	// Return if we got an error on our setup of our credentials.
+	// Now that we're in, see what shares there are and what we can do with them.  Not
+	// being able to list them doesn't mean the login didn't work.
+	shares, admin, err := this.enumerateShares(session)
 	if err != nil {
-		result.Message = err.Error()
-		result.Status = false
+		result.Output = "Share Error: " + err.Error()
+	} else {
+		result.Output = shares
+	}
+	if admin {
+		result.Info["local_admin"] = "true"
+	} else {
+		result.Info["local_admin"] = "false"
 	}
-	defer session.Close()
 
-	// Here we should actually connect to the protocol and see, example:
-	if session.IsAuthenticated {
-		result.Message = "Logon failed."
-		result.Status = false
+	// If we have a command to run, let's do it.
+	if cmd != "" {
+		// Execute the command
+		var output, cleanup string
+		output, cleanup, err = this.executeCommand(session, cmd)
+		if err != nil {
+			// If we got an error, let's give the user some output.
+			output = "Command Error: " + err.Error()
+		}
+		if cleanup != "" {
+			result.Info["cleanup"] = cleanup
+		}
+		result.Output += "\n" + output
 	}
 
 	// Finally, let's pass our result to the proper channel to write out to the user
 	outChan <- result
 }
 
+// Connects to the host and logs in, returns the connection and session so they can
+// be closed when we're done.
+func (this Scanner) connect(host string, initiator *smb2.NTLMInitiator) (net.Conn, *smb2.Session, error) {
+	conn, err := scanners.Dial("tcp", host)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(60 * time.Second))
+
+	dialer := &smb2.Dialer{Initiator: initiator}
+	session, err := dialer.Dial(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, session, nil
+}
+
+// Lists the shares on the host over SRVSVC and tries each one to see if we can read
+// and write to it.  Returns one share per line, and whether we got into an admin share.
+func (this Scanner) enumerateShares(session *smb2.Session) (string, bool, error) {
+	names, err := session.ListSharenames()
+	if err != nil {
+		return "", false, err
+	}
+
+	admin := false
+	lines := []string{}
+	for _, name := range names {
+		// IPC$ is just for pipes, there's nothing to read or write on it
+		if strings.ToUpper(name) == "IPC$" {
+			continue
+		}
+
+		read, write := this.checkAccess(session, name)
+		access := []string{}
+		if read {
+			access = append(access, "READ")
+		}
+		if write {
+			access = append(access, "WRITE")
+		}
+		if len(access) == 0 {
+			access = append(access, "NO ACCESS")
+		}
+		if adminShares[strings.ToUpper(name)] && (read || write) {
+			admin = true
+		}
+		lines = append(lines, name+"\t"+strings.Join(access, ","))
+	}
+
+	return strings.Join(lines, "\n"), admin, nil
+}
+
+// Mounts a share and checks if we can list it and create something on it.  For the
+// write check we open the top of the share asking for the right to add a directory,
+// which is checked against the share and folder permissions the same as making one
+// would be, but nothing gets created.  On a directory that right is the one the
+// library asks for with append.
+func (this Scanner) checkAccess(session *smb2.Session, name string) (bool, bool) {
+	share, err := session.Mount(name)
+	if err != nil {
+		return false, false
+	}
+	defer share.Umount()
+
+	_, err = share.ReadDir("")
+	read := err == nil
+
+	root, err := share.OpenFile("", os.O_WRONLY|os.O_APPEND, 0)
+	write := err == nil
+	if write {
+		root.Close()
+	}
+
+	return read, write
+}
+
+// Runs a command by creating a temporary service over SVCCTL whose command line runs
+// it and saves the output to a file under ADMIN$, then reads that back.  The service
+// and file are removed afterwards and we check they're really gone, which comes back
+// as the second return so the user knows if anything was left on the host.
+func (this Scanner) executeCommand(session *smb2.Session, cmd string) (string, string, error) {
+	ipc, err := session.Mount("IPC$")
+	if err != nil {
+		return "", "", err
+	}
+	defer ipc.Umount()
+
+	pipe, err := ipc.OpenFile("svcctl", os.O_RDWR, 0666)
+	if err != nil {
+		return "", "", err
+	}
+	defer pipe.Close()
+
+	rpc := newSvcctl(pipe)
+	if err := rpc.bind(); err != nil {
+		return "", "", err
+	}
+	scm, err := rpc.openSCManager()
+	if err != nil {
+		return "", "", err
+	}
+	defer rpc.closeHandle(scm)
+
+	// ADMIN$ is the Windows directory, so the service can write there and we can read it
+	admin, err := session.Mount("ADMIN$")
+	if err != nil {
+		return "", "", err
+	}
+	defer admin.Umount()
+
+	random := make([]byte, 8)
+	rand.Read(random)
+	name := "netscan" + hex.EncodeToString(random)
+	outFile := `Temp\` + name + ".txt"
+	binaryPath, err := commandLine(cmd, outFile)
+	if err != nil {
+		return "", "", err
+	}
+
+	service, err := rpc.createService(scm, name, binaryPath)
+	if err != nil {
+		return "", "", err
+	}
+
+	// The service manager waits for the command to finish before it gives up on it
+	// ever reporting in, so once this comes back the output is there.
+	runErr := rpc.startService(service)
+	rpc.deleteService(service)
+	rpc.closeHandle(service)
+
+	var output []byte
+	if runErr == nil {
+		output, runErr = this.readOutput(admin, outFile)
+	}
+	admin.Remove(outFile)
+
+	// Make sure we didn't leave anything behind
+	cleanup := this.verifyCleanup(rpc, scm, admin, name, outFile)
+	if runErr != nil {
+		return "", cleanup, runErr
+	}
+
+	// Convert our output to a string
+	tmpOut := strings.Replace(string(output), "\r\n", "\n", -1)
+	tmpOut = strings.Replace(strings.TrimRight(tmpOut, "\n"), "\n", "<br>", -1)
+
+	return tmpOut, cleanup, nil
+}
+
+// Builds the command line for the service.  The command goes in parentheses so all
+// of it is redirected to the output file, not just the part after the last & or |.
+func commandLine(cmd, outFile string) (string, error) {
+	binaryPath := `%COMSPEC% /Q /c (` + cmd + `) > %SYSTEMROOT%\` + outFile + ` 2>&1`
+	if len(utf16.Encode([]rune(binaryPath))) > maxCommandLine {
+		return "", fmt.Errorf("Command is too long, cmd.exe takes at most %d characters", maxCommandLine)
+	}
+	return binaryPath, nil
+}
+
+// Reads the output file, giving the command a few seconds in case it's still being
+// written or the file is still locked.
+func (this Scanner) readOutput(share *smb2.Share, path string) ([]byte, error) {
+	var output []byte
+	var err error
+	for i := 0; i < 10; i++ {
+		if output, err = share.ReadFile(path); err == nil {
+			return output, nil
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return nil, err
+}
+
+// Checks that the service and output file are both gone from the host.  Returns "ok"
+// if they are, otherwise what was left behind.
+func (this Scanner) verifyCleanup(rpc *svcctl, scm scHandle, share *smb2.Share, name, outFile string) string {
+	leftovers := []string{}
+
+	service, err := rpc.openService(scm, name)
+	if err == nil {
+		rpc.closeHandle(service)
+		leftovers = append(leftovers, "service "+name)
+	} else if status, ok := err.(scError); !ok || status != errorServiceDoesNotExist {
+		leftovers = append(leftovers, "service "+name+" ("+err.Error()+")")
+	}
+
+	if _, err := share.Stat(outFile); !os.IsNotExist(err) {
+		leftovers = append(leftovers, `file ADMIN$\`+outFile)
+	}
+
+	if len(leftovers) == 0 {
+		return "ok"
+	}
+	return "left behind: " + strings.Join(leftovers, ", ")
+}
+
+// Takes an error from logging in and turns it into something that tells the user
+// what happened, along with whether the credentials were still good.
+func (this Scanner) classifyError(err error) (string, bool) {
+	var responseErr *smb2.ResponseError
+	if errors.As(err, &responseErr) {
+		if message, valid, ok := scanners.NTStatusMessage(responseErr.Code); ok {
+			return message, valid
+		}
+	}
+	return err.Error(), false
+}
+
 // Creates a new scanner for us to add to the main loop
 func NewScanner() scanners.Scanner {
 	return &Scanner{}
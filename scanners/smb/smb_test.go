@@ -0,0 +1,21 @@
+package smb
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCommandLine(t *testing.T) {
+	got, err := commandLine("whoami & hostname | findstr x", `Temp\out.txt`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `%COMSPEC% /Q /c (whoami & hostname | findstr x) > %SYSTEMROOT%\Temp\out.txt 2>&1`
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if _, err := commandLine(strings.Repeat("x", maxCommandLine), `Temp\out.txt`); err == nil {
+		t.Error("a command past the cmd.exe limit was accepted")
+	}
+}
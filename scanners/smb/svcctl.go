@@ -0,0 +1,387 @@
+package smb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+// DCERPC packet types we send and get back
+const (
+	rpcRequest  = 0
+	rpcResponse = 2
+	rpcFault    = 3
+	rpcBind     = 11
+	rpcBindAck  = 12
+)
+
+// The most we'll send or take in a single fragment
+const rpcMaxFrag = 4280
+
+// The SVCCTL calls we make, by opnum
+const (
+	opCloseServiceHandle = 0
+	opDeleteService      = 2
+	opCreateServiceW     = 12
+	opOpenSCManagerW     = 15
+	opOpenServiceW       = 16
+	opStartServiceW      = 19
+)
+
+// Access rights and service settings for the calls above
+const (
+	scManagerAllAccess     = 0x000f003f
+	serviceAllAccess       = 0x000f01ff
+	serviceWin32OwnProcess = 0x00000010
+	serviceDemandStart     = 0x00000003
+	serviceErrorIgnore     = 0x00000000
+)
+
+// Windows error codes we expect to see from the service manager
+const (
+	errorAccessDenied           = 5
+	errorServiceRequestTimeout  = 1053
+	errorServiceDoesNotExist    = 1060
+	errorServiceMarkedForDelete = 1072
+)
+
+// The interface we bind to and the NDR transfer syntax we speak
+var (
+	svcctlUUID = rpcUUID("367abb81-9844-35f1-ad32-98f038001003")
+	ndrUUID    = rpcUUID("8a885d04-1ceb-11c9-9fe8-08002b104860")
+)
+
+// A handle to the service manager or a service, it's opaque to us
+type scHandle [20]byte
+
+// A small client for the service control manager over a named pipe.  It works on
+// anything we can read and write RPC packets to, so it doesn't have to be SMB.
+type svcctl struct {
+	pipe    io.ReadWriter
+	callID  uint32
+	pending []byte // What we've read past the end of the last fragment
+}
+
+// Wraps a pipe in a client, call bind before anything else
+func newSvcctl(pipe io.ReadWriter) *svcctl {
+	return &svcctl{pipe: pipe}
+}
+
+// Binds to the SVCCTL interface so we can start making calls
+func (this *svcctl) bind() error {
+	body := new(bytes.Buffer)
+	binary.Write(body, binary.LittleEndian, []uint16{rpcMaxFrag, rpcMaxFrag})
+	binary.Write(body, binary.LittleEndian, uint32(0)) // Association group
+	body.Write([]byte{1, 0, 0, 0})                     // One context
+	binary.Write(body, binary.LittleEndian, uint16(0)) // Context ID
+	body.Write([]byte{1, 0})                           // One transfer syntax
+	body.Write(svcctlUUID)
+	binary.Write(body, binary.LittleEndian, uint32(2)) // SVCCTL v2.0
+	body.Write(ndrUUID)
+	binary.Write(body, binary.LittleEndian, uint32(2)) // NDR v2
+
+	ptype, reply, err := this.roundTrip(rpcBind, body.Bytes())
+	if err != nil {
+		return err
+	}
+	if ptype != rpcBindAck {
+		return errors.New("Server refused to bind to SVCCTL")
+	}
+
+	// Skip past the secondary address to the first result, zero means accepted
+	if len(reply) < 10 {
+		return errors.New("Invalid bind response")
+	}
+	offset := 10 + int(binary.LittleEndian.Uint16(reply[8:]))
+	offset += (4 - offset%4) % 4
+	if len(reply) < offset+6 || binary.LittleEndian.Uint16(reply[offset+4:]) != 0 {
+		return errors.New("Server refused to bind to SVCCTL")
+	}
+	return nil
+}
+
+// Opens the service control manager with full access, which takes a local admin
+func (this *svcctl) openSCManager() (scHandle, error) {
+	args := &ndr{}
+	args.addUint32(0) // No machine name, the server ignores it anyway
+	args.addUint32(0) // Default database
+	args.addUint32(scManagerAllAccess)
+
+	return this.callHandle(opOpenSCManagerW, args)
+}
+
+// Creates a service that runs the command line we were given when it starts
+func (this *svcctl) createService(scm scHandle, name, binaryPath string) (scHandle, error) {
+	args := &ndr{}
+	args.addHandle(scm)
+	args.addString(name)
+	args.addPointer()
+	args.addString(name) // Display name
+	args.addUint32(serviceAllAccess)
+	args.addUint32(serviceWin32OwnProcess)
+	args.addUint32(serviceDemandStart)
+	args.addUint32(serviceErrorIgnore)
+	args.addString(binaryPath)
+	args.addUint32(0) // Load order group
+	args.addUint32(0) // Tag ID
+	args.addUint32(0) // Dependencies
+	args.addUint32(0)
+	args.addUint32(0) // Run as LocalSystem
+	args.addUint32(0) // Password
+	args.addUint32(0)
+
+	return this.callHandle(opCreateServiceW, args)
+}
+
+// Opens an existing service by name
+func (this *svcctl) openService(scm scHandle, name string) (scHandle, error) {
+	args := &ndr{}
+	args.addHandle(scm)
+	args.addString(name)
+	args.addUint32(serviceAllAccess)
+
+	return this.callHandle(opOpenServiceW, args)
+}
+
+// Starts a service.  Our services are just a command so they never tell the manager
+// they're running, which means a timeout here is what success looks like.
+func (this *svcctl) startService(service scHandle) error {
+	args := &ndr{}
+	args.addHandle(service)
+	args.addUint32(0) // No arguments
+	args.addUint32(0)
+
+	_, err := this.call(opStartServiceW, args)
+	if status, ok := err.(scError); ok && status == errorServiceRequestTimeout {
+		return nil
+	}
+	return err
+}
+
+// Marks a service for deletion, it's gone once every handle to it is closed
+func (this *svcctl) deleteService(service scHandle) error {
+	args := &ndr{}
+	args.addHandle(service)
+
+	_, err := this.call(opDeleteService, args)
+	return err
+}
+
+// Closes a handle to the service manager or a service
+func (this *svcctl) closeHandle(handle scHandle) error {
+	args := &ndr{}
+	args.addHandle(handle)
+
+	_, err := this.call(opCloseServiceHandle, args)
+	return err
+}
+
+// Makes a call that gives us back a handle.  The handle always sits right before the
+// return code at the end of the response.
+func (this *svcctl) callHandle(opnum uint16, args *ndr) (scHandle, error) {
+	var handle scHandle
+	reply, err := this.call(opnum, args)
+	if err != nil {
+		return handle, err
+	}
+	if len(reply) < 24 {
+		return handle, errors.New("Invalid SVCCTL response")
+	}
+	copy(handle[:], reply[len(reply)-24:])
+	return handle, nil
+}
+
+// Makes a call and returns the response, or an error if the call failed or the
+// return code at the end of the response wasn't success.
+func (this *svcctl) call(opnum uint16, args *ndr) ([]byte, error) {
+	body := new(bytes.Buffer)
+	binary.Write(body, binary.LittleEndian, uint32(args.Len())) // Allocation hint
+	binary.Write(body, binary.LittleEndian, uint16(0))          // Context ID
+	binary.Write(body, binary.LittleEndian, opnum)
+	body.Write(args.Bytes())
+
+	ptype, reply, err := this.roundTrip(rpcRequest, body.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if ptype == rpcFault && len(reply) >= 12 {
+		return nil, fmt.Errorf("RPC fault 0x%08x", binary.LittleEndian.Uint32(reply[8:]))
+	}
+	if ptype != rpcResponse || len(reply) < 12 {
+		return nil, errors.New("Invalid SVCCTL response")
+	}
+
+	// Past the allocation hint, context ID and cancel count is the stub data
+	stub := reply[8:]
+	if status := binary.LittleEndian.Uint32(stub[len(stub)-4:]); status != 0 {
+		return stub, scError(status)
+	}
+	return stub, nil
+}
+
+// Sends a packet and reads the whole response back, putting the fragments together
+// if there's more than one.  Returns the packet type and the body after the header.
+func (this *svcctl) roundTrip(ptype byte, body []byte) (byte, []byte, error) {
+	this.callID++
+	if err := this.send(ptype, body); err != nil {
+		return 0, nil, err
+	}
+
+	var replyType byte
+	var reply []byte
+	for {
+		fragment, err := this.readFragment()
+		if err != nil {
+			return 0, nil, err
+		}
+		replyType = fragment[2]
+
+		// Every fragment of a response has the same header, so after the first one
+		// we only want the stub data
+		if reply == nil {
+			reply = fragment[16:]
+		} else if len(fragment) > 24 {
+			reply = append(reply, fragment[24:]...)
+		}
+
+		if fragment[3]&0x02 != 0 {
+			break
+		}
+	}
+
+	return replyType, reply, nil
+}
+
+// Writes a packet to the pipe.  Requests too big for one fragment are split up, with
+// the request header (allocation hint, context ID and opnum) repeated on each piece.
+func (this *svcctl) send(ptype byte, body []byte) error {
+	if ptype != rpcRequest || 16+len(body) <= rpcMaxFrag {
+		return this.writeFragment(ptype, 0x03, body)
+	}
+
+	header, stub := body[:8], body[8:]
+	size := rpcMaxFrag - 16 - len(header)
+	for offset := 0; offset < len(stub); offset += size {
+		end := offset + size
+		if end > len(stub) {
+			end = len(stub)
+		}
+
+		var flags byte
+		if offset == 0 {
+			flags |= 0x01 // First fragment
+		}
+		if end == len(stub) {
+			flags |= 0x02 // Last fragment
+		}
+
+		piece := append(append([]byte{}, header...), stub[offset:end]...)
+		if err := this.writeFragment(ptype, flags, piece); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes a single fragment with the RPC header in front of it
+func (this *svcctl) writeFragment(ptype, flags byte, body []byte) error {
+	packet := new(bytes.Buffer)
+	packet.Write([]byte{5, 0, ptype, flags, 0x10, 0, 0, 0})
+	binary.Write(packet, binary.LittleEndian, uint16(16+len(body)))
+	binary.Write(packet, binary.LittleEndian, uint16(0))
+	binary.Write(packet, binary.LittleEndian, this.callID)
+	packet.Write(body)
+
+	_, err := this.pipe.Write(packet.Bytes())
+	return err
+}
+
+// Reads a single fragment off the pipe.  Pipe reads can come back short, or with
+// the start of the next fragment on the end, so we keep going until we have as much
+// as the header says there is and hang on to anything past it.
+func (this *svcctl) readFragment() ([]byte, error) {
+	buf := make([]byte, rpcMaxFrag)
+	for len(this.pending) < 16 || len(this.pending) < int(binary.LittleEndian.Uint16(this.pending[8:])) {
+		n, err := this.pipe.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		this.pending = append(this.pending, buf[:n]...)
+	}
+	if this.pending[0] != 5 || binary.LittleEndian.Uint16(this.pending[8:]) < 16 {
+		return nil, errors.New("Invalid RPC response")
+	}
+
+	length := binary.LittleEndian.Uint16(this.pending[8:])
+	fragment := this.pending[:length:length]
+	this.pending = this.pending[length:]
+	return fragment, nil
+}
+
+// An error code the service manager gave back to us
+type scError uint32
+
+func (this scError) Error() string {
+	switch this {
+	case errorAccessDenied:
+		return "Access denied by the service manager, local admin is needed"
+	case errorServiceDoesNotExist:
+		return "Service does not exist"
+	case errorServiceMarkedForDelete:
+		return "Service is marked for deletion"
+	default:
+		return fmt.Sprintf("Service manager error %d", uint32(this))
+	}
+}
+
+// Builds up the NDR encoded arguments for a call
+type ndr struct {
+	bytes.Buffer
+}
+
+// Adds a 32 bit number, lined up on a 4 byte boundary like NDR wants
+func (this *ndr) addUint32(value uint32) {
+	this.align()
+	binary.Write(&this.Buffer, binary.LittleEndian, value)
+}
+
+// Adds a non-null unique pointer, what it points at needs to come right after
+func (this *ndr) addPointer() {
+	this.addUint32(0x00020000)
+}
+
+// Adds a context handle
+func (this *ndr) addHandle(handle scHandle) {
+	this.align()
+	this.Write(handle[:])
+}
+
+// Adds a null terminated UTF-16 string
+func (this *ndr) addString(value string) {
+	chars := utf16.Encode([]rune(value + "\x00"))
+	this.addUint32(uint32(len(chars)))
+	this.addUint32(0)
+	this.addUint32(uint32(len(chars)))
+	binary.Write(&this.Buffer, binary.LittleEndian, chars)
+}
+
+// Pads out to the next 4 byte boundary
+func (this *ndr) align() {
+	for this.Len()%4 != 0 {
+		this.WriteByte(0)
+	}
+}
+
+// Turns a UUID string into the mixed endian bytes RPC uses
+func rpcUUID(uuid string) []byte {
+	b, _ := hex.DecodeString(strings.Replace(uuid, "-", "", -1))
+	binary.LittleEndian.PutUint32(b[0:], binary.BigEndian.Uint32(b[0:]))
+	binary.LittleEndian.PutUint16(b[4:], binary.BigEndian.Uint16(b[4:]))
+	binary.LittleEndian.PutUint16(b[6:], binary.BigEndian.Uint16(b[6:]))
+	return b
+}
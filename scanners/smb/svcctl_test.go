@@ -0,0 +1,277 @@
+package smb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+)
+
+// A pipe that plays back responses we scripted.  Each time a last fragment is
+// written, the next response is queued up to be read, a few bytes at a time so we
+// see short reads like a real pipe gives.
+type scriptedPipe struct {
+	writes    [][]byte
+	responses [][]byte
+	pending   []byte
+	readSize  int
+}
+
+func (this *scriptedPipe) Write(p []byte) (int, error) {
+	this.writes = append(this.writes, append([]byte{}, p...))
+	if p[3]&0x02 != 0 && len(this.responses) > 0 {
+		this.pending = append(this.pending, this.responses[0]...)
+		this.responses = this.responses[1:]
+	}
+	return len(p), nil
+}
+
+func (this *scriptedPipe) Read(p []byte) (int, error) {
+	if len(this.pending) == 0 {
+		return 0, io.EOF
+	}
+	if this.readSize > 0 && len(p) > this.readSize {
+		p = p[:this.readSize]
+	}
+	n := copy(p, this.pending)
+	this.pending = this.pending[n:]
+	return n, nil
+}
+
+// Builds a fragment the way the server would send it
+func fragment(ptype, flags byte, body []byte) []byte {
+	packet := new(bytes.Buffer)
+	packet.Write([]byte{5, 0, ptype, flags, 0x10, 0, 0, 0})
+	binary.Write(packet, binary.LittleEndian, uint16(16+len(body)))
+	binary.Write(packet, binary.LittleEndian, uint16(0))
+	binary.Write(packet, binary.LittleEndian, uint32(1))
+	packet.Write(body)
+	return packet.Bytes()
+}
+
+// Builds a response fragment carrying stub data
+func response(flags byte, stub []byte) []byte {
+	body := make([]byte, 8, 8+len(stub))
+	binary.LittleEndian.PutUint32(body, uint32(len(stub)))
+	return fragment(rpcResponse, flags, append(body, stub...))
+}
+
+// Stub data for a call that hands back a handle
+func handleStub(handle scHandle, status uint32) []byte {
+	stub := append([]byte{}, handle[:]...)
+	return binary.LittleEndian.AppendUint32(stub, status)
+}
+
+// Stub data for a call that only returns a status
+func statusStub(status uint32) []byte {
+	return binary.LittleEndian.AppendUint32(nil, status)
+}
+
+// A bind acknowledgement with a secondary address of the given length and a result
+func bindAck(address string, result uint16) []byte {
+	body := new(bytes.Buffer)
+	binary.Write(body, binary.LittleEndian, []uint16{rpcMaxFrag, rpcMaxFrag})
+	binary.Write(body, binary.LittleEndian, uint32(0x1234))
+	binary.Write(body, binary.LittleEndian, uint16(len(address)))
+	body.WriteString(address)
+	for (16+body.Len())%4 != 0 {
+		body.WriteByte(0)
+	}
+	body.Write([]byte{1, 0, 0, 0})
+	binary.Write(body, binary.LittleEndian, result)
+	binary.Write(body, binary.LittleEndian, uint16(0))
+	body.Write(ndrUUID)
+	binary.Write(body, binary.LittleEndian, uint32(2))
+	return fragment(rpcBindAck, 0x03, body.Bytes())
+}
+
+func TestBind(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply []byte
+		ok    bool
+	}{
+		{"accepted", bindAck(`\PIPE\svcctl`, 0), true},
+		{"accepted with odd address", bindAck(`\PIPE\ntsvcs`+"\x00", 0), true},
+		{"rejected", bindAck(`\PIPE\svcctl`, 2), false},
+		{"wrong packet", fragment(rpcFault, 0x03, make([]byte, 16)), false},
+		{"short", fragment(rpcBindAck, 0x03, make([]byte, 4)), false},
+	}
+
+	for _, test := range tests {
+		pipe := &scriptedPipe{responses: [][]byte{test.reply}, readSize: 7}
+		err := newSvcctl(pipe).bind()
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+
+		sent := pipe.writes[0]
+		if sent[2] != rpcBind || !bytes.Contains(sent, svcctlUUID) || !bytes.Contains(sent, ndrUUID) {
+			t.Errorf("%s: bind request is missing the interface or transfer syntax", test.name)
+		}
+	}
+}
+
+func TestOpenSCManagerEncoding(t *testing.T) {
+	handle := scHandle{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	pipe := &scriptedPipe{responses: [][]byte{response(0x03, handleStub(handle, 0))}}
+
+	got, err := newSvcctl(pipe).openSCManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != handle {
+		t.Errorf("got handle %x, want %x", got, handle)
+	}
+
+	sent := pipe.writes[0]
+	if sent[2] != rpcRequest || sent[3] != 0x03 {
+		t.Errorf("got packet type %d flags %x, want a single request fragment", sent[2], sent[3])
+	}
+	if length := binary.LittleEndian.Uint16(sent[8:]); int(length) != len(sent) {
+		t.Errorf("header says %d bytes, sent %d", length, len(sent))
+	}
+	if opnum := binary.LittleEndian.Uint16(sent[22:]); opnum != opOpenSCManagerW {
+		t.Errorf("got opnum %d, want %d", opnum, opOpenSCManagerW)
+	}
+
+	// Two null pointers and the access mask
+	want := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0x3f, 0, 0x0f, 0}
+	if !bytes.Equal(sent[24:], want) {
+		t.Errorf("got arguments %x, want %x", sent[24:], want)
+	}
+}
+
+func TestNDRString(t *testing.T) {
+	args := &ndr{}
+	args.WriteByte(0xff) // Strings have to line up after whatever came before
+	args.addString("ab")
+
+	want := []byte{
+		0xff, 0, 0, 0,
+		3, 0, 0, 0, // Max count
+		0, 0, 0, 0, // Offset
+		3, 0, 0, 0, // Actual count
+		'a', 0, 'b', 0, 0, 0,
+	}
+	if !bytes.Equal(args.Bytes(), want) {
+		t.Errorf("got %x, want %x", args.Bytes(), want)
+	}
+}
+
+func TestStartService(t *testing.T) {
+	tests := []struct {
+		name   string
+		status uint32
+		want   string
+	}{
+		{"started", 0, ""},
+		{"never reported in", errorServiceRequestTimeout, ""},
+		{"access denied", errorAccessDenied, "Access denied by the service manager, local admin is needed"},
+		{"other", 1056, "Service manager error 1056"},
+	}
+
+	for _, test := range tests {
+		pipe := &scriptedPipe{responses: [][]byte{response(0x03, statusStub(test.status))}}
+		err := newSvcctl(pipe).startService(scHandle{})
+
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestOpenServiceMissing(t *testing.T) {
+	pipe := &scriptedPipe{responses: [][]byte{response(0x03, handleStub(scHandle{}, errorServiceDoesNotExist))}}
+	_, err := newSvcctl(pipe).openService(scHandle{}, "netscan")
+	if status, ok := err.(scError); !ok || status != errorServiceDoesNotExist {
+		t.Errorf("got %v, want service does not exist", err)
+	}
+}
+
+func TestFault(t *testing.T) {
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint32(body[8:], 0x1c010003)
+	pipe := &scriptedPipe{responses: [][]byte{fragment(rpcFault, 0x03, body)}}
+
+	_, err := newSvcctl(pipe).openSCManager()
+	if err == nil || err.Error() != "RPC fault 0x1c010003" {
+		t.Errorf("got %v, want the fault code", err)
+	}
+}
+
+func TestFragmentedResponse(t *testing.T) {
+	handle := scHandle{0xaa, 0xbb}
+	stub := handleStub(handle, 0)
+
+	// The server is free to split the stub anywhere, the handle here goes across the
+	// two fragments
+	pipe := &scriptedPipe{responses: [][]byte{
+		append(response(0x01, stub[:10]), response(0x02, stub[10:])...),
+	}, readSize: 5}
+
+	got, err := newSvcctl(pipe).openSCManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != handle {
+		t.Errorf("got handle %x, want %x", got, handle)
+	}
+}
+
+func TestFragmentedRequest(t *testing.T) {
+	handle := scHandle{0x42}
+	pipe := &scriptedPipe{responses: [][]byte{response(0x03, handleStub(handle, 0))}}
+
+	// Long enough to need three fragments
+	binaryPath := strings.Repeat("x", rpcMaxFrag)
+	got, err := newSvcctl(pipe).createService(scHandle{}, "netscan", binaryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != handle {
+		t.Errorf("got handle %x, want %x", got, handle)
+	}
+	if len(pipe.writes) != 3 {
+		t.Fatalf("sent %d fragments, want 3", len(pipe.writes))
+	}
+
+	wantFlags := []byte{0x01, 0x00, 0x02}
+	var stub []byte
+	var allocHint uint32
+	for i, sent := range pipe.writes {
+		if len(sent) > rpcMaxFrag {
+			t.Errorf("fragment %d is %d bytes, the most is %d", i, len(sent), rpcMaxFrag)
+		}
+		if length := binary.LittleEndian.Uint16(sent[8:]); int(length) != len(sent) {
+			t.Errorf("fragment %d header says %d bytes, sent %d", i, length, len(sent))
+		}
+		if sent[3] != wantFlags[i] {
+			t.Errorf("fragment %d has flags %x, want %x", i, sent[3], wantFlags[i])
+		}
+		if callID := binary.LittleEndian.Uint32(sent[12:]); callID != 1 {
+			t.Errorf("fragment %d has call ID %d, want 1", i, callID)
+		}
+		if opnum := binary.LittleEndian.Uint16(sent[22:]); opnum != opCreateServiceW {
+			t.Errorf("fragment %d has opnum %d, want %d", i, opnum, opCreateServiceW)
+		}
+		allocHint = binary.LittleEndian.Uint32(sent[16:])
+		stub = append(stub, sent[24:]...)
+	}
+
+	// Put back together, it has to be what we'd have sent in one piece
+	args := &ndr{}
+	args.addHandle(scHandle{})
+	args.addString("netscan")
+	if !bytes.HasPrefix(stub, args.Bytes()) {
+		t.Error("stub data doesn't start with the handle and service name")
+	}
+	if int(allocHint) != len(stub) {
+		t.Errorf("allocation hint is %d, stub is %d bytes", allocHint, len(stub))
+	}
+}
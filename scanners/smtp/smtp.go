@@ -1,6 +1,9 @@
 package smtp
 
 import (
+	"crypto/tls"
+	"errors"
+	"io"
 	"strings"
 
 	"github.com/emersion/go-sasl"
@@ -63,7 +66,7 @@ func (this Scanner) Scan(target, cmd string, cred scanners.Credential, outChan c
 			"Subject: go-netscan test!\r\n" +
 			"\r\n" +
 			"This is a test email.\r\n")
-		err := smtp.SendMail(target, auth, cred.Account, to, msg)
+		err := this.sendMail(target, auth, cred.Account, to, msg)
 		if err != nil {
 			result.Message = err.Error()
 			result.Status = false
@@ -75,6 +78,54 @@ func (this Scanner) Scan(target, cmd string, cred scanners.Credential, outChan c
 	outChan <- result
 }
 
+// Connects with our dialer and sends a message, the same way the library's SendMail
+// does.  STARTTLS is used if the server has it, without checking the certificate
+// since we're testing credentials.
+func (this Scanner) sendMail(target string, auth sasl.Client, from string, to []string, msg io.Reader) error {
+	conn, err := scanners.Dial("tcp", target)
+	if err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, strings.Split(target, ":")[0])
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+			return err
+		}
+	}
+	if ok, _ := c.Extension("AUTH"); !ok {
+		return errors.New("smtp: server doesn't support AUTH")
+	}
+	if err := c.Auth(auth); err != nil {
+		return err
+	}
+	if err := c.Mail(from, nil); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
 // Creates a new scanner for us to add to the main loop
 func NewScanner() scanners.Scanner {
 	return &Scanner{}
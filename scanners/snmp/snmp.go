@@ -0,0 +1,318 @@
+package snmp
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emperorcow/go-netscan/scanners"
+	"github.com/gosnmp/gosnmp"
+)
+
+// The OIDs we'll grab from every device we get into
+const (
+	oidSysDescr = "1.3.6.1.2.1.1.1.0"
+	oidSysName  = "1.3.6.1.2.1.1.5.0"
+)
+
+// Friendly names for the OIDs above so the output is easier to read
+var oidNames = map[string]string{
+	oidSysDescr: "sysDescr",
+	oidSysName:  "sysName",
+}
+
+// The authentication protocols a v3 user can have, by the name used in credential files
+var authProtocols = map[string]gosnmp.SnmpV3AuthProtocol{
+	"MD5":    gosnmp.MD5,
+	"SHA":    gosnmp.SHA,
+	"SHA224": gosnmp.SHA224,
+	"SHA256": gosnmp.SHA256,
+	"SHA384": gosnmp.SHA384,
+	"SHA512": gosnmp.SHA512,
+}
+
+// The privacy protocols a v3 user can have, by the name used in credential files
+var privProtocols = map[string]gosnmp.SnmpV3PrivProtocol{
+	"DES":     gosnmp.DES,
+	"AES":     gosnmp.AES,
+	"AES192":  gosnmp.AES192,
+	"AES256":  gosnmp.AES256,
+	"AES192C": gosnmp.AES192C,
+	"AES256C": gosnmp.AES256C,
+}
+
+// This is our scanner and does all the work from the main
+type Scanner struct {
+	version string // The SNMP version to use with community strings, 1 or 2c
+}
+
+// Returns the name of this scanner
+func (this Scanner) Name() string {
+	return "snmp"
+}
+
+// Returns a description of this scanner
+func (this Scanner) Description() string {
+	return "Simple Network Management Protocol (SNMP)"
+}
+
+// Returns the types of auth we support in this scanner
+func (this Scanner) SupportedAuthentication() []string {
+	return []string{"basic", "usm"}
+}
+
+// Returns some examples on how to configure the auth info
+func (this Scanner) SupportedAuthenticationExample() map[string]string {
+	return map[string]string{
+		"basic": "COMMUNITY",
+		"usm":   "USERNAME,AUTHPROTO:AUTHPASS,PRIVPROTO:PRIVPASS (MD5/SHA and DES/AES, privacy is optional, only PRIVPASS can have commas)",
+	}
+}
+
+// Adds our flags to the command line
+func (this *Scanner) RegisterFlags(flags *flag.FlagSet) {
+	flags.StringVar(&this.version, "snmp-version", "2c", "SNMP version to use with community strings (1, 2c).")
+}
+
+// Runs the actual scan, takes an input of our target, the creds we need to use for this one,
+// a command to run if we have one, and our out channel for results.  The command can be
+// an OID to GET, or "walk" and an OID to WALK.
+func (this Scanner) Scan(target, cmd string, cred scanners.Credential, outChan chan scanners.Result) {
+	// Check our target and see if the default port is there, if not we include it.
+	host, port, targetErr := splitTarget(target)
+	if targetErr == nil {
+		target = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+
+	// Let's assume that we connected successfully and declare the data as such, we can edit it later if we failed
+	result := scanners.Result{
+		Host:    target,
+		Auth:    cred,
+		Message: "Successfully connected",
+		Status:  true,
+		Output:  "",
+	}
+
+	if targetErr != nil {
+		result.Message = targetErr.Error()
+		result.Status = false
+		outChan <- result
+		return
+	}
+
+	client := &gosnmp.GoSNMP{
+		Target:  host,
+		Port:    port,
+		Timeout: 2 * time.Second,
+		Retries: 1,
+		MaxOids: gosnmp.MaxOids,
+	}
+
+	// Depending on the authentication type, setup the client for the right version
+	var err error
+	switch cred.Type {
+	case "basic":
+		client.Community = cred.AuthData
+		client.Version = gosnmp.Version2c
+		if this.version == "1" {
+			client.Version = gosnmp.Version1
+		}
+	case "usm":
+		err = this.prepUSM(client, cred.Account, cred.AuthData)
+	}
+
+	// Since this is UDP, connecting just sets up our socket.  The library opens its
+	// own, so we swap in one from our dialer once it's done setting up.
+	if err == nil {
+		err = client.Connect()
+	}
+	if err == nil {
+		client.Conn.Close()
+		client.Conn, err = scanners.Dial("udp", target)
+	}
+	if err != nil {
+		result.Message = err.Error()
+		result.Status = false
+		outChan <- result
+		return
+	}
+	defer client.Conn.Close()
+
+	// Getting something back is the only way to know the credential worked, so
+	// we'll ask for the system description and name.
+	result.Output, err = this.get(client, oidSysDescr, oidSysName)
+
+	// If we got an error, let's set the data properly
+	if err != nil {
+		result.Message = this.classifyError(err)
+		result.Status = false
+	}
+
+	// If we didn't get an error and we have a command to run, let's do it.
+	if err == nil && cmd != "" {
+		// Execute the command
+		var output string
+		output, err = this.executeCommand(client, cmd)
+		if err != nil {
+			// If we got an error, let's give the user some output.
+			output = "Command Error: " + err.Error()
+		}
+		result.Output += "\n" + output
+	}
+
+	// Finally, let's pass our result to the proper channel to write out to the user
+	outChan <- result
+}
+
+// Splits a target into its host and port, using the default port if it doesn't have
+// one.  IPv6 addresses need brackets around them when there's a port.
+func splitTarget(target string) (string, uint16, error) {
+	host, portString, err := net.SplitHostPort(target)
+	if err != nil {
+		// No port, so the whole thing is the host
+		host, portString = strings.Trim(target, "[]"), "161"
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil || host == "" {
+		return "", 0, errors.New("Invalid target: " + target)
+	}
+	return host, uint16(port), nil
+}
+
+// Sets up the client for a SNMPv3 user.  The auth data has the authentication and
+// privacy settings, each as PROTOCOL:PASSPHRASE.  Privacy can be left off, but SNMPv3
+// has no privacy without authentication.  The privacy passphrase is the last field
+// so it's the one that can have commas in it.
+func (this Scanner) prepUSM(client *gosnmp.GoSNMP, user, authData string) error {
+	params := &gosnmp.UsmSecurityParameters{
+		UserName:               user,
+		AuthenticationProtocol: gosnmp.NoAuth,
+		PrivacyProtocol:        gosnmp.NoPriv,
+	}
+	flags := gosnmp.NoAuthNoPriv
+
+	parts := strings.SplitN(authData, ",", 2)
+	if len(parts) > 1 && parts[1] != "" && parts[0] == "" {
+		return errors.New("Privacy needs an authentication protocol too, use AUTHPROTO:AUTHPASS,PRIVPROTO:PRIVPASS")
+	}
+	if parts[0] != "" {
+		protoPass := strings.SplitN(parts[0], ":", 2)
+		proto, ok := authProtocols[strings.ToUpper(protoPass[0])]
+		if !ok || len(protoPass) != 2 {
+			return errors.New("Unknown authentication protocol: " + protoPass[0])
+		}
+		params.AuthenticationProtocol = proto
+		params.AuthenticationPassphrase = protoPass[1]
+		flags = gosnmp.AuthNoPriv
+	}
+	if len(parts) > 1 && parts[1] != "" {
+		protoPass := strings.SplitN(parts[1], ":", 2)
+		proto, ok := privProtocols[strings.ToUpper(protoPass[0])]
+		if !ok || len(protoPass) != 2 {
+			return errors.New("Unknown privacy protocol: " + protoPass[0])
+		}
+		params.PrivacyProtocol = proto
+		params.PrivacyPassphrase = protoPass[1]
+		flags = gosnmp.AuthPriv
+	}
+
+	client.Version = gosnmp.Version3
+	client.SecurityModel = gosnmp.UserSecurityModel
+	client.MsgFlags = flags
+	client.SecurityParameters = params
+	return nil
+}
+
+// Takes an error from our first request and turns it into something that tells the
+// user what was wrong.  With community strings a bad guess just gets ignored, but v3
+// agents tell us which part was wrong.
+func (this Scanner) classifyError(err error) string {
+	switch {
+	case errors.Is(err, gosnmp.ErrUnknownUsername):
+		return "Unknown user name"
+	case errors.Is(err, gosnmp.ErrWrongDigest):
+		return "Wrong authentication password"
+	case errors.Is(err, gosnmp.ErrDecryption):
+		return "Wrong privacy password"
+	case errors.Is(err, gosnmp.ErrUnknownSecurityLevel):
+		return "Unsupported security level for this user"
+	case strings.Contains(err.Error(), "timeout"):
+		return "No response, bad community or no SNMP agent"
+	default:
+		return err.Error()
+	}
+}
+
+// Runs a GET or WALK from the command line and returns the values we got
+func (this Scanner) executeCommand(client *gosnmp.GoSNMP, cmd string) (string, error) {
+	fields := strings.Fields(cmd)
+	if len(fields) == 2 && strings.ToLower(fields[0]) == "walk" {
+		return this.walk(client, fields[1])
+	}
+	return this.get(client, fields...)
+}
+
+// Gets the OIDs we were given and returns them one per line
+func (this Scanner) get(client *gosnmp.GoSNMP, oids ...string) (string, error) {
+	packet, err := client.Get(oids)
+	if err != nil {
+		return "", err
+	}
+
+	lines := []string{}
+	for _, pdu := range packet.Variables {
+		lines = append(lines, this.formatPDU(pdu))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// Walks everything under an OID and returns the values one per line.  SNMPv1 doesn't
+// have GETBULK so we have to do it the slow way there.
+func (this Scanner) walk(client *gosnmp.GoSNMP, oid string) (string, error) {
+	var pdus []gosnmp.SnmpPDU
+	var err error
+	if client.Version == gosnmp.Version1 {
+		pdus, err = client.WalkAll(oid)
+	} else {
+		pdus, err = client.BulkWalkAll(oid)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	lines := []string{}
+	for _, pdu := range pdus {
+		lines = append(lines, this.formatPDU(pdu))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// Turns a single value into an OID = VALUE line
+func (this Scanner) formatPDU(pdu gosnmp.SnmpPDU) string {
+	var value string
+	switch pdu.Type {
+	case gosnmp.OctetString:
+		value = string(pdu.Value.([]byte))
+	case gosnmp.NoSuchObject, gosnmp.NoSuchInstance, gosnmp.EndOfMibView, gosnmp.Null:
+		value = pdu.Type.String()
+	case gosnmp.Integer, gosnmp.Counter32, gosnmp.Gauge32, gosnmp.TimeTicks, gosnmp.Counter64, gosnmp.Uinteger32:
+		value = gosnmp.ToBigInt(pdu.Value).String()
+	default:
+		value = fmt.Sprint(pdu.Value)
+	}
+
+	name := strings.TrimPrefix(pdu.Name, ".")
+	if friendly, ok := oidNames[name]; ok {
+		name = friendly
+	}
+	return name + " = " + value
+}
+
+// Creates a new scanner for us to add to the main loop
+func NewScanner() scanners.Scanner {
+	return &Scanner{}
+}
@@ -0,0 +1,84 @@
+package snmp
+
+import (
+	"testing"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+func TestSplitTarget(t *testing.T) {
+	tests := []struct {
+		target string
+		host   string
+		port   uint16
+		err    bool
+	}{
+		{"10.0.0.1", "10.0.0.1", 161, false},
+		{"10.0.0.1:1161", "10.0.0.1", 1161, false},
+		{"switch.corp.local", "switch.corp.local", 161, false},
+		{"fe80::1", "fe80::1", 161, false},
+		{"[fe80::1]", "fe80::1", 161, false},
+		{"[fe80::1]:1161", "fe80::1", 1161, false},
+		{"10.0.0.1:snmp", "", 0, true},
+		{"10.0.0.1:70000", "", 0, true},
+		{":161", "", 0, true},
+	}
+	for _, test := range tests {
+		host, port, err := splitTarget(test.target)
+		if host != test.host || port != test.port || (err != nil) != test.err {
+			t.Errorf("%s: got %q %d %v", test.target, host, port, err)
+		}
+	}
+}
+
+func TestPrepUSM(t *testing.T) {
+	tests := []struct {
+		name     string
+		authData string
+		flags    gosnmp.SnmpV3MsgFlags
+		auth     gosnmp.SnmpV3AuthProtocol
+		authPass string
+		priv     gosnmp.SnmpV3PrivProtocol
+		privPass string
+	}{
+		{"no auth", "", gosnmp.NoAuthNoPriv, gosnmp.NoAuth, "", gosnmp.NoPriv, ""},
+		{"auth", "sha:authpass", gosnmp.AuthNoPriv, gosnmp.SHA, "authpass", gosnmp.NoPriv, ""},
+		{"auth and priv", "SHA256:authpass,AES:privpass", gosnmp.AuthPriv, gosnmp.SHA256, "authpass", gosnmp.AES, "privpass"},
+		{"empty priv", "MD5:authpass,", gosnmp.AuthNoPriv, gosnmp.MD5, "authpass", gosnmp.NoPriv, ""},
+		{"commas and colons in the privacy passphrase", "SHA:authpass,AES:a,b:c", gosnmp.AuthPriv, gosnmp.SHA, "authpass", gosnmp.AES, "a,b:c"},
+		{"colons in the authentication passphrase", "SHA:a:b", gosnmp.AuthNoPriv, gosnmp.SHA, "a:b", gosnmp.NoPriv, ""},
+	}
+	for _, test := range tests {
+		client := &gosnmp.GoSNMP{}
+		if err := (Scanner{}).prepUSM(client, "admin", test.authData); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		params := client.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+		if client.Version != gosnmp.Version3 || client.MsgFlags != test.flags || params.UserName != "admin" ||
+			params.AuthenticationProtocol != test.auth || params.AuthenticationPassphrase != test.authPass ||
+			params.PrivacyProtocol != test.priv || params.PrivacyPassphrase != test.privPass {
+			t.Errorf("%s: got flags %v and %+v", test.name, client.MsgFlags, params)
+		}
+	}
+}
+
+func TestPrepUSMInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		authData string
+		err      string
+	}{
+		{"privacy without authentication", ",AES:privpass", "Privacy needs an authentication protocol too, use AUTHPROTO:AUTHPASS,PRIVPROTO:PRIVPASS"},
+		{"unknown authentication", "SHA1024:authpass", "Unknown authentication protocol: SHA1024"},
+		{"no authentication passphrase", "SHA", "Unknown authentication protocol: SHA"},
+		{"unknown privacy", "SHA:authpass,3DES:privpass", "Unknown privacy protocol: 3DES"},
+		{"comma in the authentication passphrase", "SHA:auth,pass", "Unknown privacy protocol: pass"},
+	}
+	for _, test := range tests {
+		err := (Scanner{}).prepUSM(&gosnmp.GoSNMP{}, "admin", test.authData)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%s: got %v, want %q", test.name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// The ways we can handle host keys
+const (
+	hostKeyRecord = "record" // Accept any key, write down what we saw
+	hostKeyStrict = "strict" // Only accept keys already in the known_hosts file
+	hostKeyTOFU   = "tofu"   // Accept and write down keys for new hosts, check the rest
+)
+
+// A host presented a different key than the one we have for it
+type hostKeyMismatch struct {
+	host string
+	want []string // Fingerprints we have for the host
+	got  string   // Fingerprint the host gave us
+}
+
+func (this hostKeyMismatch) Error() string {
+	return fmt.Sprintf("HOST KEY MISMATCH for %s, expected %s but got %s", this.host, strings.Join(this.want, " or "), this.got)
+}
+
+// A host we have no key for in strict mode
+var errUnknownHostKey = errors.New("Host key is not in the known_hosts file")
+
+// The known_hosts file shared by every scan.  The file is read once, and keys we see
+// after that are kept in memory as well as added to the file, so every routine sees
+// them right away.
+type knownHosts struct {
+	path    string
+	load    sync.Once
+	loadErr error
+	file    ssh.HostKeyCallback        // Checks against what was in the file when we started
+	mutex   sync.Mutex                 // Held while checking and adding a key, so they happen together
+	seen    map[string][]ssh.PublicKey // Keys we've added since, by normalized address
+}
+
+// Reads the file the first time we need it.  Not having a file yet is fine, we'll
+// make it when we have something to write.
+func (this *knownHosts) open() error {
+	this.load.Do(func() {
+		this.seen = map[string][]ssh.PublicKey{}
+		if this.path == "" {
+			return
+		}
+		if _, err := os.Stat(this.path); os.IsNotExist(err) {
+			return
+		}
+		this.file, this.loadErr = knownhosts.New(this.path)
+	})
+	return this.loadErr
+}
+
+// Builds the callback for one connection.  Whatever key the host gives us goes into
+// info, and a key that doesn't match the one we have is flagged there too, even in
+// record mode where we still let the connection through without recording it.
+func (this *knownHosts) callback(mode string, info map[string]string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if err := this.open(); err != nil {
+			return err
+		}
+
+		fingerprint := ssh.FingerprintSHA256(key)
+		info["host_key"] = key.Type() + " " + fingerprint
+
+		// Several connections to a new host can show up at once, only the first one
+		// gets to add its key and the rest are checked against it
+		this.mutex.Lock()
+		defer this.mutex.Unlock()
+
+		known, want := this.check(hostname, remote, key)
+		switch {
+		case known:
+			return nil
+		case len(want) > 0:
+			// The new key is never stored, so every scan of the host keeps flagging it
+			// and a later strict run won't trust it
+			mismatch := hostKeyMismatch{host: hostname, want: want, got: fingerprint}
+			info["host_key_mismatch"] = strings.Join(want, ",")
+			if mode == hostKeyRecord {
+				return nil
+			}
+			return mismatch
+		case mode == hostKeyStrict:
+			return errUnknownHostKey
+		default:
+			return this.add(hostname, key)
+		}
+	}
+}
+
+// Checks a key against the ones we know for the host.  Returns whether it's one of
+// them, and if not, the fingerprints of the ones we have.  No fingerprints means we've
+// never seen the host.  The mutex has to be held.
+func (this *knownHosts) check(hostname string, remote net.Addr, key ssh.PublicKey) (bool, []string) {
+	want := []string{}
+
+	for _, seen := range this.seen[knownhosts.Normalize(hostname)] {
+		if string(seen.Marshal()) == string(key.Marshal()) {
+			return true, nil
+		}
+		want = append(want, ssh.FingerprintSHA256(seen))
+	}
+
+	if this.file != nil {
+		err := this.file(hostname, remote, key)
+		if err == nil {
+			return true, nil
+		}
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) {
+			for _, knownKey := range keyErr.Want {
+				want = append(want, ssh.FingerprintSHA256(knownKey.Key))
+			}
+		}
+	}
+	return false, want
+}
+
+// Remembers a key for a host and appends it to the file if we have one.  The mutex
+// has to be held.
+func (this *knownHosts) add(hostname string, key ssh.PublicKey) error {
+	address := knownhosts.Normalize(hostname)
+
+	this.seen[address] = append(this.seen[address], key)
+	if this.path == "" {
+		return nil
+	}
+
+	file, err := os.OpenFile(this.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(knownhosts.Line([]string{address}, key) + "\n")
+	return err
+}
@@ -0,0 +1,144 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newHostKey(t *testing.T) ssh.PublicKey {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+var testAddr = &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+
+// Connects to a host from lots of routines all let go at once, each one getting the
+// key for its number, and returns how many were let through
+func connectAll(hosts *knownHosts, host, mode string, keys []ssh.PublicKey, count int) int {
+	var wait sync.WaitGroup
+	var mutex sync.Mutex
+	accepted := 0
+	start := make(chan bool)
+	for i := 0; i < count; i++ {
+		wait.Add(1)
+		go func(key ssh.PublicKey) {
+			defer wait.Done()
+			<-start
+			if hosts.callback(mode, map[string]string{})(host, testAddr, key) == nil {
+				mutex.Lock()
+				accepted++
+				mutex.Unlock()
+			}
+		}(keys[i%len(keys)])
+	}
+	close(start)
+	wait.Wait()
+	return accepted
+}
+
+// Reads the known_hosts file back a line at a time
+func knownLines(t *testing.T, path string) []string {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(contents)), "\n")
+}
+
+func TestTOFUNewHostOnce(t *testing.T) {
+	hosts := &knownHosts{path: filepath.Join(t.TempDir(), "known_hosts")}
+	key := newHostKey(t)
+
+	// The race is over quickly, so run it for a lot of new hosts
+	for i := 0; i < 50; i++ {
+		host := "10.0.0." + strconv.Itoa(i) + ":22"
+		if accepted := connectAll(hosts, host, hostKeyTOFU, []ssh.PublicKey{key}, 20); accepted != 20 {
+			t.Errorf("%s: accepted %d of 20 connections with the same key", host, accepted)
+		}
+	}
+	if lines := knownLines(t, hosts.path); len(lines) != 50 {
+		t.Errorf("wrote %d lines for 50 hosts", len(lines))
+	}
+}
+
+func TestTOFURacingKeys(t *testing.T) {
+	hosts := &knownHosts{path: filepath.Join(t.TempDir(), "known_hosts")}
+	first, second := newHostKey(t), newHostKey(t)
+
+	// Whichever key gets there first is trusted, the other is a mismatch every time
+	for i := 0; i < 50; i++ {
+		host := "10.0.0." + strconv.Itoa(i) + ":22"
+		if accepted := connectAll(hosts, host, hostKeyTOFU, []ssh.PublicKey{first, second}, 20); accepted != 10 {
+			t.Errorf("%s: accepted %d of 20 connections, want the 10 with one key", host, accepted)
+		}
+	}
+	if lines := knownLines(t, hosts.path); len(lines) != 50 {
+		t.Errorf("wrote %d keys for 50 hosts", len(lines))
+	}
+}
+
+func TestRecordMismatch(t *testing.T) {
+	hosts := &knownHosts{path: filepath.Join(t.TempDir(), "known_hosts")}
+	first, second := newHostKey(t), newHostKey(t)
+
+	hosts.callback(hostKeyRecord, map[string]string{})("10.0.0.1:22", testAddr, first)
+
+	// A changed key still gets through in record mode, but it's flagged and not kept
+	for i := 0; i < 2; i++ {
+		info := map[string]string{}
+		if err := hosts.callback(hostKeyRecord, info)("10.0.0.1:22", testAddr, second); err != nil {
+			t.Fatal(err)
+		}
+		if info["host_key_mismatch"] != ssh.FingerprintSHA256(first) {
+			t.Errorf("attempt %d: got mismatch %q", i+1, info["host_key_mismatch"])
+		}
+	}
+	if lines := knownLines(t, hosts.path); len(lines) != 1 {
+		t.Errorf("wrote %d keys for one host, want 1", len(lines))
+	}
+
+	// And strict mode doesn't let it through at all
+	if err := hosts.callback(hostKeyStrict, map[string]string{})("10.0.0.1:22", testAddr, second); err == nil {
+		t.Error("strict mode accepted a changed key")
+	}
+}
+
+func TestJumpHostMismatch(t *testing.T) {
+	hosts := &knownHosts{path: filepath.Join(t.TempDir(), "known_hosts")}
+	first, second := newHostKey(t), newHostKey(t)
+	dialer := &JumpDialer{scanner: Scanner{hostKeyMode: hostKeyRecord, knownHosts: hosts}}
+
+	callback, err := dialer.hostKeyCallback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := callback("bastion:22", testAddr, first); err != nil {
+		t.Fatalf("new jump host was refused: %v", err)
+	}
+
+	// Record mode lets a changed key through for targets, but never for a jump host
+	var mismatch hostKeyMismatch
+	if err := callback("bastion:22", testAddr, second); !errors.As(err, &mismatch) {
+		t.Errorf("got %v, want a host key mismatch", err)
+	}
+	if dialer.scanner.hostKeyMode != hostKeyRecord {
+		t.Error("the scanner's own mode was changed")
+	}
+}
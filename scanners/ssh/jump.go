@@ -0,0 +1,173 @@
+package ssh
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/emperorcow/go-netscan/scanners"
+	"golang.org/x/crypto/ssh"
+)
+
+// One SSH host we go through on the way to our targets
+type jumpHop struct {
+	address string
+	cred    scanners.Credential
+}
+
+// Connects to targets through one or more SSH jump hosts, the same as ssh -J.  We
+// log in to the chain once and every routine opens its connections over it, so the
+// bastion only sees one login no matter how many targets we hit.  If the chain goes
+// down we log in again the next time something needs it.
+type JumpDialer struct {
+	scanner Scanner
+	hops    []jumpHop
+	forward scanners.Dialer // How we get to the first hop
+	mutex   sync.Mutex
+	client  *ssh.Client // The last hop, nil until we've logged in
+	closers []io.Closer // Everything to close when the chain goes down
+}
+
+// Sets up a jump dialer from a list of hosts like ssh -J (user@host:port, comma
+// separated) and the auth type to log in to them with.  The auth data is the same as
+// for the credential file without the user, and can be one per hop separated by
+// semicolons or one for all of them.  Host keys are checked with our -ssh-hostkey
+// settings.  The first hop is reached with whatever the default dialer is right now,
+// so a proxy has to be set up before this.  Nothing connects until the first dial.
+func (this *Scanner) NewJumpDialer(spec, authType, authData string) (*JumpDialer, error) {
+	supported := false
+	for _, auth := range this.SupportedAuthentication() {
+		supported = supported || auth == authType
+	}
+	if !supported {
+		return nil, errors.New("Authentication type " + authType + " isn't supported for jump hosts")
+	}
+
+	hosts := strings.Split(spec, ",")
+	auths := strings.Split(authData, ";")
+	if len(auths) != 1 && len(auths) != len(hosts) {
+		return nil, errors.New("Need one jump host credential, or one for each jump host")
+	}
+
+	dialer := &JumpDialer{scanner: *this, forward: scanners.DefaultDialer}
+	for i, host := range hosts {
+		at := strings.LastIndex(host, "@")
+		if at <= 0 {
+			return nil, errors.New("Jump host " + host + " needs a user (user@host:port)")
+		}
+		address := host[at+1:]
+		if !strings.Contains(address, ":") {
+			address = address + ":22"
+		}
+
+		auth := auths[0]
+		if len(auths) > 1 {
+			auth = auths[i]
+		}
+		dialer.hops = append(dialer.hops, jumpHop{
+			address: address,
+			cred:    scanners.Credential{Type: authType, Account: host[:at], AuthData: auth},
+		})
+	}
+	return dialer, nil
+}
+
+// Opens a connection to an address from the last jump host.  SSH can only forward
+// TCP, so anything else is an error.
+func (this *JumpDialer) Dial(network, address string) (net.Conn, error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil, errors.New("Can't send " + network + " through an SSH jump host")
+	}
+	client, err := this.connect()
+	if err != nil {
+		return nil, err
+	}
+	return client.Dial(network, address)
+}
+
+// Returns the client for the last hop, logging in to the chain if we aren't already
+func (this *JumpDialer) connect() (*ssh.Client, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.client != nil {
+		return this.client, nil
+	}
+
+	var client *ssh.Client
+	for _, hop := range this.hops {
+		next, err := this.login(client, hop)
+		if err != nil {
+			this.close()
+			return nil, errors.New("Jump host " + hop.address + ": " + err.Error())
+		}
+		client = next
+	}
+
+	// When the last hop goes away, forget about the chain so the next dial starts over
+	this.client = client
+	go func() {
+		client.Wait()
+		this.mutex.Lock()
+		defer this.mutex.Unlock()
+		if this.client == client {
+			this.close()
+		}
+	}()
+	return client, nil
+}
+
+// Logs in to one hop, through the one before it if there is one
+func (this *JumpDialer) login(previous *ssh.Client, hop jumpHop) (*ssh.Client, error) {
+	config, _, agentConn, err := this.scanner.prepConfig(hop.cred)
+	if agentConn != nil {
+		this.closers = append(this.closers, agentConn)
+	}
+	if err == nil {
+		config.HostKeyCallback, err = this.hostKeyCallback()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	if previous == nil {
+		conn, err = this.forward.Dial("tcp", hop.address)
+	} else {
+		conn, err = previous.Dial("tcp", hop.address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, hop.address, &config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	client := ssh.NewClient(sshConn, chans, reqs)
+	this.closers = append(this.closers, client)
+	return client, nil
+}
+
+// Builds the host key callback for a hop.  Everything we send to our targets goes
+// through the jump hosts, so a changed key is refused here even in record mode, which
+// for targets only notes it.  New keys are still recorded the same way.
+func (this *JumpDialer) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	scanner := this.scanner
+	if scanner.hostKeyMode == hostKeyRecord {
+		scanner.hostKeyMode = hostKeyTOFU
+	}
+	return scanner.hostKeyCallback(map[string]string{})
+}
+
+// Closes everything in the chain, last hop first
+func (this *JumpDialer) close() {
+	for i := len(this.closers) - 1; i >= 0; i-- {
+		this.closers[i].Close()
+	}
+	this.closers = nil
+	this.client = nil
+}
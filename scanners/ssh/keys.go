@@ -0,0 +1,131 @@
+package ssh
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Key files we've already loaded, so trying the same key against a lot of hosts only
+// reads and decrypts it once.  Keys that failed to load are kept too, a wrong
+// passphrase isn't going to get any better.
+type keyCache struct {
+	mutex sync.Mutex
+	keys  map[string]*cachedKey
+}
+
+// A key we've loaded, or the error we got trying
+type cachedKey struct {
+	signer ssh.Signer
+	err    error
+}
+
+// Returns the signer for a key file, loading it if we haven't yet
+func (this *keyCache) get(keyPath, passphrase string) (ssh.Signer, error) {
+	cacheKey := keyPath + "\x00" + passphrase
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.keys == nil {
+		this.keys = map[string]*cachedKey{}
+	}
+	if key, ok := this.keys[cacheKey]; ok {
+		return key.signer, key.err
+	}
+
+	signer, err := loadKey(keyPath, passphrase)
+	this.keys[cacheKey] = &cachedKey{signer: signer, err: err}
+	return signer, err
+}
+
+// Reads a private key, decrypting it with the passphrase if we have one.  If there's
+// an OpenSSH certificate next to it (key-cert.pub) we log in with that instead.
+func loadKey(keyPath, passphrase string) (ssh.Signer, error) {
+	keyData, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var signer ssh.Signer
+	if passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(keyData, []byte(passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(keyData)
+	}
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		return nil, errors.New("Key is encrypted, add the passphrase after the path: USERNAME,/path/to/key,PASSPHRASE")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	certData, err := ioutil.ReadFile(keyPath + "-cert.pub")
+	if os.IsNotExist(err) {
+		return signer, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(certData)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := publicKey.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("Not an OpenSSH certificate: " + keyPath + "-cert.pub")
+	}
+	return ssh.NewCertSigner(cert, signer)
+}
+
+// Connects to the SSH agent at SSH_AUTH_SOCK and builds a config that logs in with
+// its keys.  A filter picks out one key by its SHA256 fingerprint or comment, which
+// helps when the agent has more keys than the server lets us try.  The connection to
+// the agent is handed back since it's needed until we're logged in.
+func (this Scanner) prepAgentConfig(user, filter string) (ssh.ClientConfig, net.Conn, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return ssh.ClientConfig{}, nil, errors.New("SSH_AUTH_SOCK isn't set, is an agent running?")
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return ssh.ClientConfig{}, nil, err
+	}
+
+	client := agent.NewClient(conn)
+	signers := func() ([]ssh.Signer, error) {
+		all, err := client.Signers()
+		if err != nil || filter == "" {
+			return all, err
+		}
+
+		keys, err := client.List()
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if key.Comment != filter && ssh.FingerprintSHA256(key) != filter {
+				continue
+			}
+			for _, signer := range all {
+				if string(signer.PublicKey().Marshal()) == string(key.Marshal()) {
+					return []ssh.Signer{signer}, nil
+				}
+			}
+		}
+		return nil, errors.New("No key in the agent matches " + filter)
+	}
+
+	conf := ssh.ClientConfig{
+		User: user,
+		Auth: []ssh.AuthMethod{ssh.PublicKeysCallback(signers)},
+	}
+	return conf, conn, nil
+}
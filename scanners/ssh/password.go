@@ -0,0 +1,95 @@
+package ssh
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Servers tell us a password has expired in all sorts of ways, PAM mostly says
+// "You are required to change your password immediately"
+var expiredPassword = regexp.MustCompile(`(?i)(password (has )?expired|required to change|must change|change your password)`)
+
+// Prompts for a new password only show up once the old one was accepted
+var newPasswordPrompt = regexp.MustCompile(`(?i)(new|retype|re-enter|confirm)[^:]*password`)
+
+// We stop answering prompts with these so we never send a password twice, since every
+// one we send counts towards locking the account out.
+var (
+	errPasswordChange   = errors.New("password must be changed")
+	errPasswordRejected = errors.New("password rejected")
+)
+
+// Logs in with a password, using the password method or answering keyboard-interactive
+// prompts for servers that only do that (usually PAM).  It keeps track of whether the
+// server told us the password has to be changed, which means it was right.
+type passwordAuth struct {
+	password   string
+	sent       bool // Whether we've already sent the password once
+	mustChange bool // Whether the server wants the password changed
+}
+
+// Returns the auth methods to give the client.  The client only tries the ones the
+// server allows, in this order.  Keyboard-interactive goes first since the password
+// method can't tell us about an expired password in a way that survives the client
+// moving on to the next method.
+func (this *passwordAuth) methods() []ssh.AuthMethod {
+	return []ssh.AuthMethod{
+		ssh.KeyboardInteractive(this.challenge),
+		ssh.PasswordCallback(this.passwordMethod),
+	}
+}
+
+// Gives the password to the password method, unless we've already sent it
+func (this *passwordAuth) passwordMethod() (string, error) {
+	if this.sent {
+		return "", errPasswordRejected
+	}
+	this.sent = true
+	return this.password, nil
+}
+
+// Answers keyboard-interactive prompts.  Hidden prompts get the password, anything
+// the server wants echoed we leave blank.  Once we've sent the password, the server
+// saying it expired or asking for a new one means it was right, so we stop, and if it
+// asks for the password again it didn't like it.  Before that it's only a banner, like
+// a reminder to change passwords every so often, and proves nothing.
+func (this *passwordAuth) challenge(name, instruction string, questions []string, echos []bool) ([]string, error) {
+	if this.sent && expiredPassword.MatchString(name+" "+instruction) {
+		this.mustChange = true
+		return nil, errPasswordChange
+	}
+
+	answers := make([]string, len(questions))
+	for i, question := range questions {
+		switch {
+		case this.sent && (newPasswordPrompt.MatchString(question) || expiredPassword.MatchString(question)):
+			this.mustChange = true
+			return nil, errPasswordChange
+		case echos[i]:
+			continue
+		case this.sent:
+			return nil, errPasswordRejected
+		default:
+			answers[i] = this.password
+			this.sent = true
+		}
+	}
+	return answers, nil
+}
+
+// Turns an error from logging in with a password into a message for the user, along
+// with whether the credentials were good.  A password change request means the
+// password was right, whether it came from a prompt or the password method's own
+// SSH_MSG_USERAUTH_PASSWD_CHANGEREQ (type 60), which the client library doesn't handle.
+func (this *passwordAuth) classifyError(err error) (string, bool) {
+	if this.mustChange || strings.Contains(err.Error(), "unexpected message type 60") {
+		return "Valid credentials, but the password must be changed", true
+	}
+	if errors.Is(err, errPasswordRejected) {
+		return "Invalid credentials", false
+	}
+	return err.Error(), false
+}
@@ -0,0 +1,131 @@
+package ssh
+
+import (
+	"errors"
+	"testing"
+)
+
+// One round of keyboard-interactive prompts from the server
+type round struct {
+	instruction string
+	questions   []string
+	echos       []bool
+}
+
+// Plays the rounds through a password auth the way the client library would, stopping
+// at the first error, and returns the answers we gave and the error we stopped with.
+func play(auth *passwordAuth, rounds []round) ([][]string, error) {
+	answers := [][]string{}
+	for _, r := range rounds {
+		answer, err := auth.challenge("", r.instruction, r.questions, r.echos)
+		if err != nil {
+			return answers, err
+		}
+		answers = append(answers, answer)
+	}
+	return answers, nil
+}
+
+func TestChallenge(t *testing.T) {
+	password := round{questions: []string{"Password: "}, echos: []bool{false}}
+
+	tests := []struct {
+		name    string
+		rounds  []round
+		sent    int   // How many rounds we answer with the password
+		err     error // What we stop with
+		message string
+		valid   bool
+	}{
+		{
+			"banner before the password, then asked again",
+			[]round{{instruction: "Remember to change your password every 90 days", questions: []string{"Password: "}, echos: []bool{false}}, password},
+			1, errPasswordRejected, "Invalid credentials", false,
+		},
+		{
+			"banner asking for the password under a change reminder",
+			[]round{{questions: []string{"Password (you must change it soon): "}, echos: []bool{false}}, password},
+			1, errPasswordRejected, "Invalid credentials", false,
+		},
+		{
+			"pam expired",
+			[]round{password, {instruction: "You are required to change your password immediately (administrator enforced)", questions: []string{"Current password: "}, echos: []bool{false}}},
+			1, errPasswordChange, "Valid credentials, but the password must be changed", true,
+		},
+		{
+			"asked for a new password",
+			[]round{password, {questions: []string{"New password: "}, echos: []bool{false}}},
+			1, errPasswordChange, "Valid credentials, but the password must be changed", true,
+		},
+		{
+			"password asked for again",
+			[]round{password, password},
+			1, errPasswordRejected, "Invalid credentials", false,
+		},
+		{
+			"user name echoed first",
+			[]round{{questions: []string{"Username: ", "Password: "}, echos: []bool{true, false}}},
+			1, nil, "", false,
+		},
+	}
+
+	for _, test := range tests {
+		auth := &passwordAuth{password: "hunter2"}
+		answers, err := play(auth, test.rounds)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+		}
+
+		sent := 0
+		for _, answer := range answers {
+			for _, a := range answer {
+				if a == "hunter2" {
+					sent++
+				}
+			}
+		}
+		if sent != test.sent {
+			t.Errorf("%s: sent the password %d times, want %d", test.name, sent, test.sent)
+		}
+
+		if err != nil {
+			if message, valid := auth.classifyError(err); message != test.message || valid != test.valid {
+				t.Errorf("%s: got %q %v, want %q %v", test.name, message, valid, test.message, test.valid)
+			}
+		}
+	}
+}
+
+func TestPasswordMethod(t *testing.T) {
+	auth := &passwordAuth{password: "hunter2"}
+	if password, err := auth.passwordMethod(); password != "hunter2" || err != nil {
+		t.Errorf("got %q %v", password, err)
+	}
+	if _, err := auth.passwordMethod(); !errors.Is(err, errPasswordRejected) {
+		t.Errorf("sent the password twice, got %v", err)
+	}
+
+	// Keyboard-interactive after the password method doesn't get it either
+	if _, err := auth.challenge("", "", []string{"Password: "}, []bool{false}); !errors.Is(err, errPasswordRejected) {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err     error
+		message string
+		valid   bool
+	}{
+		{errors.New("ssh: handshake failed: ssh: unexpected message type 60 (expected one of [51 52])"), "Valid credentials, but the password must be changed", true},
+		{errors.New("ssh: handshake failed: ssh: unable to authenticate, attempted methods [none password], no supported methods remain"),
+			"ssh: handshake failed: ssh: unable to authenticate, attempted methods [none password], no supported methods remain", false},
+		{errors.New("dial tcp 10.0.0.1:22: connect: connection refused"), "dial tcp 10.0.0.1:22: connect: connection refused", false},
+	}
+	for _, test := range tests {
+		auth := &passwordAuth{password: "hunter2", sent: true}
+		if message, valid := auth.classifyError(test.err); message != test.message || valid != test.valid {
+			t.Errorf("%v: got %q %v", test.err, message, valid)
+		}
+	}
+}
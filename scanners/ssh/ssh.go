@@ -1,7 +1,9 @@
 package ssh
 
 import (
-	"io/ioutil"
+	"errors"
+	"flag"
+	"net"
 	"strings"
 
 	"github.com/emperorcow/go-netscan/scanners"
@@ -9,7 +11,11 @@ import (
 )
 
 // This is our scanner and does all the work from the main
-type Scanner struct{}
+type Scanner struct {
+	hostKeyMode string      // How we check host keys: record, strict or tofu
+	knownHosts  *knownHosts // The known_hosts file every scan shares
+	keys        *keyCache   // Private keys we've loaded, shared by every scan
+}
 
 // Returns the name of this scanner
 func (this Scanner) Name() string {
@@ -23,17 +29,24 @@ func (this Scanner) Description() string {
 
 // Returns the types of auth we support in this scanner
 func (this Scanner) SupportedAuthentication() []string {
-	return []string{"basic", "sshkey"}
+	return []string{"basic", "sshkey", "sshagent"}
 }
 
 // Returns some examples on how to configure the auth info
 func (this Scanner) SupportedAuthenticationExample() map[string]string {
 	return map[string]string{
-		"basic":  "USERNAME,PASSWORD",
-		"sshkey": "USERNAME,/path/to/key/file.pem",
+		"basic":    "USERNAME,PASSWORD (password or keyboard-interactive)",
+		"sshkey":   "USERNAME,/path/to/key/file.pem or USERNAME,/path/to/key/file.pem,PASSPHRASE (uses file.pem-cert.pub too if it's there)",
+		"sshagent": "USERNAME, or USERNAME,KEY (keys from the agent at SSH_AUTH_SOCK, KEY picks one by SHA256 fingerprint or comment)",
 	}
 }
 
+// Adds our flags to the command line
+func (this *Scanner) RegisterFlags(flags *flag.FlagSet) {
+	flags.StringVar(&this.hostKeyMode, "ssh-hostkey", hostKeyRecord, "How to handle SSH host keys (record, strict, tofu). Record accepts any key and notes it, strict only accepts keys in -ssh-known-hosts, tofu adds new hosts and checks the rest.")
+	flags.StringVar(&this.knownHosts.path, "ssh-known-hosts", "", "known_hosts file to check SSH host keys against and record new ones in.")
+}
+
 // Runs the actual scan, takes an input of our target, the creds we need to use for this one,
 // a command to run if we have one, and our out channel for results
 func (this Scanner) Scan(target, cmd string, cred scanners.Credential, outChan chan scanners.Result) {
@@ -42,9 +55,6 @@ func (this Scanner) Scan(target, cmd string, cred scanners.Credential, outChan c
 		target = target + ":22"
 	}
 
-	var config ssh.ClientConfig
-	var err error
-
 	// Let's assume that we connected successfully and declare the data as such, we can edit it later if we failed
 	result := scanners.Result{
 		Host:    target,
@@ -52,35 +62,61 @@ func (this Scanner) Scan(target, cmd string, cred scanners.Credential, outChan c
 		Message: "Successfully connected",
 		Status:  true,
 		Output:  "",
+		Info:    map[string]string{},
 	}
 
-	// Depending on the authentication type, run the correct connection function
-	switch cred.Type {
-	case "basic":
-		config, err = this.prepPassConfig(cred.Account, cred.AuthData)
-	case "sshkey":
-		config, err = this.prepCertConfig(cred.Account, cred.AuthData)
+	// Depending on the authentication type, build the correct configuration
+	config, password, agentConn, err := this.prepConfig(cred)
+	if agentConn != nil {
+		defer agentConn.Close()
 	}
 
 	// Return if we got an error.
+	if err == nil {
+		config.HostKeyCallback, err = this.hostKeyCallback(result.Info)
+	}
 	if err != nil {
 		result.Message = err.Error()
 		result.Status = false
+		outChan <- result
+		return
 	}
 
-	_, session, err := this.connect(cred.Account, target, config)
+	client, session, err := this.connect(cred.Account, target, config)
 
-	// If we got an error, let's set the data properly
+	// If we got an error, let's set the data properly.  An expired password still
+	// means we had the right one, but we can't do anything else with it.
+	// A host key mismatch trumps everything, we never got as far as logging in.
 	if err != nil {
-		result.Message = err.Error()
-		result.Status = false
+		var mismatch hostKeyMismatch
+		result.Message, result.Status = err.Error(), false
+		if errors.As(err, &mismatch) {
+			result.Message = mismatch.Error()
+		} else if password != nil {
+			result.Message, result.Status = password.classifyError(err)
+			if password.mustChange {
+				result.Info["password"] = "must change"
+			}
+		}
+		outChan <- result
+		return
+	}
+	defer client.Close()
+	defer session.Close()
+
+	// In record mode a changed key doesn't stop us, but the user needs to know
+	if _, ok := result.Info["host_key_mismatch"]; ok {
+		result.Message += " (HOST KEY CHANGED)"
 	}
 
-	// If we didn't get an error and we have a command to run, let's do it.
-	if err == nil && cmd != "" {
+	// If we have a command to run, let's do it.
+	if cmd != "" {
 		// Execute the command
 		result.Output, err = this.executeCommand(cmd, session)
-		if err != nil {
+		if errors.Is(err, errPasswordChange) {
+			result.Message = "Valid credentials, but the password must be changed"
+			result.Info["password"] = "must change"
+		} else if err != nil {
 			// If we got an error, let's give the user some output.
 			result.Output = "Script Error: " + err.Error()
 		}
@@ -90,14 +126,39 @@ func (this Scanner) Scan(target, cmd string, cred scanners.Credential, outChan c
 	outChan <- result
 }
 
+// Builds the client configuration for a credential with the type of auth it uses.
+// Password auth is handed back so we can ask it what happened if logging in fails,
+// and agent auth hands back its connection to the agent, which has to stay open
+// until we're done logging in.
+func (this Scanner) prepConfig(cred scanners.Credential) (ssh.ClientConfig, *passwordAuth, net.Conn, error) {
+	switch cred.Type {
+	case "basic":
+		config, password, err := this.prepPassConfig(cred.Account, cred.AuthData)
+		return config, password, nil, err
+	case "sshkey":
+		config, err := this.prepCertConfig(cred.Account, cred.AuthData)
+		return config, nil, nil, err
+	case "sshagent":
+		config, agentConn, err := this.prepAgentConfig(cred.Account, cred.AuthData)
+		return config, nil, agentConn, err
+	}
+	return ssh.ClientConfig{}, nil, nil, errors.New("Unsupported authentication type " + cred.Type)
+}
+
 // Connects to a host using a SSH configuration struct.  Returns the
 // SSH client and session structs and an error if there was one.
 func (this Scanner) connect(user, host string, conf ssh.ClientConfig) (*ssh.Client, *ssh.Session, error) {
-	// Develop the network connection out
-	conn, err := ssh.Dial("tcp", host, &conf)
+	// Develop the network connection out, this might go through a jump host
+	netConn, err := scanners.Dial("tcp", host)
+	if err != nil {
+		return nil, nil, err
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(netConn, host, &conf)
 	if err != nil {
+		netConn.Close()
 		return nil, nil, err
 	}
+	conn := ssh.NewClient(sshConn, chans, reqs)
 
 	// Actually perform our connection
 	session, err := conn.NewSession()
@@ -109,10 +170,31 @@ func (this Scanner) connect(user, host string, conf ssh.ClientConfig) (*ssh.Clie
 	return conn, session, nil
 }
 
+// Builds the host key callback for a scan from our settings, the key the host gives
+// us is noted in info.
+func (this Scanner) hostKeyCallback(info map[string]string) (ssh.HostKeyCallback, error) {
+	switch this.hostKeyMode {
+	case hostKeyRecord, hostKeyTOFU:
+	case hostKeyStrict:
+		if this.knownHosts.path == "" {
+			return nil, errors.New("Strict host key checking needs -ssh-known-hosts")
+		}
+	default:
+		return nil, errors.New("Unknown host key mode " + this.hostKeyMode + ", use record, strict or tofu")
+	}
+	return this.knownHosts.callback(this.hostKeyMode, info), nil
+}
+
 // Executes a command on an SSH session struct, return an error if there is one
 func (this Scanner) executeCommand(cmd string, session *ssh.Session) (string, error) {
 	//Runs CombinedOutput, which takes cmd and returns stderr and stdout of the command
 	out, err := session.CombinedOutput(cmd)
+
+	// Some servers let an expired password log in and then refuse to run anything
+	// until it's changed, which we only find out from what the command says
+	if err != nil && expiredPassword.Match(out) {
+		return "", errPasswordChange
+	}
 	if err != nil {
 		return "", err
 	}
@@ -125,18 +207,18 @@ func (this Scanner) executeCommand(cmd string, session *ssh.Session) (string, er
 	return tmpOut, nil
 }
 
-// Connects to a target via SSH using a certificate
-func (this Scanner) prepCertConfig(user, keyPath string) (ssh.ClientConfig, error) {
-	// Load the key file  from disk
-	keyData, err := ioutil.ReadFile(keyPath)
-
-	// If we couldn't open the key file, error out.
-	if err != nil {
-		return ssh.ClientConfig{}, err
+// Connects to a target via SSH using a private key.  The auth data is the path to the
+// key, with the passphrase after another comma if it's encrypted.  Keys come from our
+// cache so each one is only loaded once.
+func (this Scanner) prepCertConfig(user, authData string) (ssh.ClientConfig, error) {
+	keyInfo := strings.SplitN(authData, ",", 2)
+	keyPath, passphrase := keyInfo[0], ""
+	if len(keyInfo) > 1 {
+		passphrase = keyInfo[1]
 	}
 
-	//Parse the private key, return if there is an error
-	signer, err := ssh.ParsePrivateKey(keyData)
+	// Load the key, return if there is an error
+	signer, err := this.keys.get(keyPath, passphrase)
 	if err != nil {
 		return ssh.ClientConfig{}, err
 	}
@@ -151,19 +233,26 @@ func (this Scanner) prepCertConfig(user, keyPath string) (ssh.ClientConfig, erro
 	return conf, nil
 }
 
-// Connects to a target using SSH with a password in a string.
-func (this Scanner) prepPassConfig(user, pass string) (ssh.ClientConfig, error) {
-	//Build our config with the password
+// Connects to a target using SSH with a password in a string.  We hand back the
+// password auth too so we can ask it what happened if logging in fails.
+func (this Scanner) prepPassConfig(user, pass string) (ssh.ClientConfig, *passwordAuth, error) {
+	password := &passwordAuth{password: pass}
+
+	//Build our config with the password, answering keyboard-interactive prompts with it too
 	conf := ssh.ClientConfig{
 		User: user,
-		Auth: []ssh.AuthMethod{ssh.Password(pass)},
+		Auth: password.methods(),
 	}
 
 	// Return our config
-	return conf, nil
+	return conf, password, nil
 }
 
 // Creates a new scanner for us to add to the main loop
 func NewScanner() scanners.Scanner {
-	return &Scanner{}
+	return &Scanner{
+		hostKeyMode: hostKeyRecord,
+		knownHosts:  &knownHosts{},
+		keys:        &keyCache{},
+	}
 }
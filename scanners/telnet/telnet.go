@@ -0,0 +1,382 @@
+package telnet
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/emperorcow/go-netscan/scanners"
+)
+
+// The telnet command bytes we care about
+const (
+	cmdSE   = 240
+	cmdSB   = 250
+	cmdWill = 251
+	cmdWont = 252
+	cmdDo   = 253
+	cmdDont = 254
+	cmdIAC  = 255
+
+	optEcho = 1
+	optSGA  = 3
+)
+
+// How long we'll give a device to show a prompt after something that looked like a
+// failure, in case it was really the banner of a good login
+const failureGrace = 2 * time.Second
+
+// This is our scanner and does all the work from the main
+type Scanner struct {
+	loginPrompt    regexpFlag // What the device asks for a username with
+	passwordPrompt regexpFlag // What the device asks for a password with
+	shellPrompt    regexpFlag // What the device shows once we're logged in
+	failure        regexpFlag // The line the device gives when the login didn't work
+}
+
+// Returns the name of this scanner
+func (this Scanner) Name() string {
+	return "telnet"
+}
+
+// Returns a description of this scanner
+func (this Scanner) Description() string {
+	return "Telnet"
+}
+
+// Returns the types of auth we support in this scanner
+func (this Scanner) SupportedAuthentication() []string {
+	return []string{"basic"}
+}
+
+// Returns some examples on how to configure the auth info
+func (this Scanner) SupportedAuthenticationExample() map[string]string {
+	return map[string]string{
+		"basic": "USERNAME,PASSWORD or PASSWORD for devices that only ask for one",
+	}
+}
+
+// Adds our flags to the command line
+func (this *Scanner) RegisterFlags(flags *flag.FlagSet) {
+	this.loginPrompt.Set(`(?i)(login|username|user name)\s*:\s*$`)
+	this.passwordPrompt.Set(`(?i)password\s*:\s*$`)
+	this.shellPrompt.Set(`[$#>%]\s*$`)
+	this.failure.Set(`(?im)^\W*(login incorrect|login invalid|login failed|authentication failed|access denied|bad password|incorrect password|invalid (user|username|password|login))`)
+
+	flags.Var(&this.loginPrompt, "telnet-login-prompt", "Regex matching the telnet username prompt.")
+	flags.Var(&this.passwordPrompt, "telnet-password-prompt", "Regex matching the telnet password prompt.")
+	flags.Var(&this.shellPrompt, "telnet-shell-prompt", "Regex matching the telnet shell prompt after a good login.")
+	flags.Var(&this.failure, "telnet-fail", "Regex matching the line telnet devices give after a bad login. A shell prompt after it still counts as a good login.")
+}
+
+// Runs the actual scan, takes an input of our target, the creds we need to use for this one,
+// a command to run if we have one, and our out channel for results
+func (this Scanner) Scan(target, cmd string, cred scanners.Credential, outChan chan scanners.Result) {
+	// Check our target and see if the default port is there, if not we include it.
+	if !strings.Contains(target, ":") {
+		target = target + ":23"
+	}
+
+	// Let's assume that we connected successfully and declare the data as such, we can edit it later if we failed
+	result := scanners.Result{
+		Host:    target,
+		Auth:    cred,
+		Message: "Successfully connected",
+		Status:  true,
+		Output:  "",
+	}
+
+	var sess *session
+	var err error
+
+	// Depending on the authentication type, run the correct connection function
+	switch cred.Type {
+	case "basic":
+		sess, err = this.connect(target, cred.Account, cred.AuthData)
+	}
+
+	// If we got an error, let's set the data properly
+	if err != nil {
+		result.Message = err.Error()
+		result.Status = false
+	}
+	if sess != nil {
+		defer sess.Close()
+		if sess.banner != "" {
+			result.Info = map[string]string{"banner": sess.banner}
+		}
+	}
+
+	// If we didn't get an error and we have a command to run, let's do it.
+	if err == nil && cmd != "" {
+		// Execute the command
+		result.Output, err = this.executeCommand(cmd, sess)
+		if err != nil {
+			// If we got an error, let's give the user some output.
+			result.Output = "Script Error: " + err.Error()
+		}
+	}
+
+	// Finally, let's pass our result to the proper channel to write out to the user
+	outChan <- result
+}
+
+// Connects to a host and walks through the login prompts.  Returns the session,
+// which may be set even if we failed so the banner can be used, and an error if
+// the login didn't work.
+func (this Scanner) connect(host, user, pass string) (*session, error) {
+	conn, err := scanners.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	s := newSession(conn)
+
+	// Some devices only ask for a password, so we'll take either prompt here
+	matched, text, err := s.readUntil(this.loginPrompt.Regexp, this.passwordPrompt.Regexp)
+	if err != nil {
+		return s, err
+	}
+	s.banner = strings.TrimSpace(this.bannerFrom(text))
+
+	if matched == 0 {
+		if err := s.writeLine(user); err != nil {
+			return s, err
+		}
+		if _, _, err := s.readUntil(this.passwordPrompt.Regexp); err != nil {
+			return s, err
+		}
+	}
+
+	if err := s.writeLine(pass); err != nil {
+		return s, err
+	}
+
+	// After the password we'll either get told no, get asked to log in again, or
+	// land on a shell.  A banner or MOTD can have lines that look like a failure
+	// ("Last failed login: ..."), so a shell prompt always wins, and if all we've seen
+	// is a failure we give the device a moment to show a prompt anyway.
+	matched, _, err = s.readUntil(this.shellPrompt.Regexp, this.loginPrompt.Regexp, this.failure.Regexp)
+	if err != nil {
+		return s, err
+	}
+	if matched == 2 {
+		if matched, _, err = s.readFor(failureGrace, this.shellPrompt.Regexp, this.loginPrompt.Regexp); err != nil {
+			return s, errors.New("Login failed")
+		}
+	}
+	if matched != 0 {
+		return s, errors.New("Login failed")
+	}
+
+	return s, nil
+}
+
+// Executes a command on a logged in session and returns whatever it printed before
+// we saw the shell prompt again.
+func (this Scanner) executeCommand(cmd string, s *session) (string, error) {
+	if err := s.writeLine(cmd); err != nil {
+		return "", err
+	}
+
+	_, text, err := s.readUntil(this.shellPrompt.Regexp)
+	if err != nil {
+		return "", err
+	}
+
+	// Drop the echo of our command off the top and the prompt off the bottom
+	lines := strings.Split(strings.Replace(text, "\r", "", -1), "\n")
+	if len(lines) > 0 && strings.Contains(lines[0], strings.TrimSpace(cmd)) {
+		lines = lines[1:]
+	}
+	if len(lines) > 0 {
+		lines = lines[:len(lines)-1]
+	}
+
+	// Convert our output to a string
+	tmpOut := strings.Join(lines, "\n")
+	tmpOut = strings.Replace(tmpOut, "\n", "<br>", -1)
+
+	return tmpOut, nil
+}
+
+// Takes everything the device sent before its first prompt and returns it without
+// the prompt itself, which is about as close to a banner as telnet gets.
+func (this Scanner) bannerFrom(text string) string {
+	text = strings.Replace(text, "\r", "", -1)
+	if i := strings.LastIndex(text, "\n"); i >= 0 {
+		return text[:i]
+	}
+	return ""
+}
+
+// A telnet session which handles the option negotiation for us so the rest of the
+// scanner only sees the text.
+type session struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	deadline time.Time // When the attempt runs out of time, zero for never
+	banner   string    // Whatever the device showed before asking us to log in
+}
+
+// Wraps a connection in a session that gives up once the attempt's -timeout is up
+func newSession(conn net.Conn) *session {
+	s := &session{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+	if scanners.Timeout > 0 {
+		s.deadline = time.Now().Add(scanners.Timeout)
+	}
+	return s
+}
+
+// Sends a line of text to the other end
+func (this *session) writeLine(line string) error {
+	this.conn.SetWriteDeadline(this.deadline)
+	_, err := this.conn.Write([]byte(line + "\r\n"))
+	return err
+}
+
+// Reads text until it matches one of the expressions we were given, or the attempt
+// runs out of time.  We only check once we've caught up with the other end so a $ in
+// a regex means the end of what it sent.  Returns which expression matched and all
+// the text we read.
+func (this *session) readUntil(patterns ...*regexp.Regexp) (int, string, error) {
+	return this.readUntilDeadline(this.deadline, patterns...)
+}
+
+// Reads like readUntil, but only waits as long as we're told to
+func (this *session) readFor(wait time.Duration, patterns ...*regexp.Regexp) (int, string, error) {
+	deadline := time.Now().Add(wait)
+	if !this.deadline.IsZero() && this.deadline.Before(deadline) {
+		deadline = this.deadline
+	}
+	return this.readUntilDeadline(deadline, patterns...)
+}
+
+// Does the reading for readUntil and readFor
+func (this *session) readUntilDeadline(deadline time.Time, patterns ...*regexp.Regexp) (int, string, error) {
+	this.conn.SetReadDeadline(deadline)
+
+	var text []byte
+	for {
+		b, err := this.readByte()
+		if err != nil {
+			return -1, string(text), err
+		}
+		if b != 0 {
+			text = append(text, b)
+		}
+
+		// Wait until there's nothing left for us to read before we check
+		if this.reader.Buffered() > 0 {
+			continue
+		}
+		for i, pattern := range patterns {
+			if pattern.Match(text) {
+				return i, string(text), nil
+			}
+		}
+	}
+}
+
+// Reads a single byte of text from the connection, answering any options the other
+// end asks about along the way.  Returns a zero byte if all we got was negotiation.
+func (this *session) readByte() (byte, error) {
+	b, err := this.reader.ReadByte()
+	if err != nil || b != cmdIAC {
+		return b, err
+	}
+
+	command, err := this.reader.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+
+	switch command {
+	case cmdIAC:
+		// An escaped 255 is just data
+		return cmdIAC, nil
+	case cmdDo, cmdDont, cmdWill, cmdWont:
+		option, err := this.reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		return 0, this.negotiate(command, option)
+	case cmdSB:
+		// We never agree to any suboptions, so just skip ahead to the end of it
+		for {
+			b, err := this.reader.ReadByte()
+			if err != nil {
+				return 0, err
+			}
+			if b == cmdIAC {
+				if b, err = this.reader.ReadByte(); err != nil || b == cmdSE {
+					return 0, err
+				}
+			}
+		}
+	default:
+		// Anything else (NOP, GA, etc.) doesn't need an answer
+		return 0, nil
+	}
+}
+
+// Answers an option request.  We'll let the server echo and suppress go-ahead since
+// that's what just about every login needs, and turn down everything else.
+func (this *session) negotiate(command, option byte) error {
+	var reply byte
+	switch command {
+	case cmdDo:
+		reply = cmdWont
+	case cmdWill:
+		if option == optEcho || option == optSGA {
+			reply = cmdDo
+		} else {
+			reply = cmdDont
+		}
+	default:
+		// DONT and WONT don't need an answer from us
+		return nil
+	}
+
+	_, err := this.conn.Write([]byte{cmdIAC, reply, option})
+	return err
+}
+
+// Closes our connection
+func (this *session) Close() error {
+	return this.conn.Close()
+}
+
+// A flag that holds a compiled regular expression
+type regexpFlag struct {
+	*regexp.Regexp
+}
+
+// Returns the expression so the help output can show it
+func (this *regexpFlag) String() string {
+	if this.Regexp == nil {
+		return ""
+	}
+	return this.Regexp.String()
+}
+
+// Compiles the expression from the command line
+func (this *regexpFlag) Set(value string) error {
+	re, err := regexp.Compile(value)
+	if err != nil {
+		return err
+	}
+	this.Regexp = re
+	return nil
+}
+
+// Creates a new scanner for us to add to the main loop
+func NewScanner() scanners.Scanner {
+	return &Scanner{}
+}
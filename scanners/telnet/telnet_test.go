@@ -0,0 +1,75 @@
+package telnet
+
+import (
+	"bufio"
+	"flag"
+	"net"
+	"testing"
+	"time"
+)
+
+// Starts a device that asks for a login and password, then sends each of the replies
+// with a pause between them
+func fakeDevice(t *testing.T, replies ...string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+
+		conn.Write([]byte("Welcome\r\nlogin: "))
+		reader.ReadString('\n')
+		conn.Write([]byte("Password: "))
+		reader.ReadString('\n')
+		for _, reply := range replies {
+			conn.Write([]byte(reply))
+			time.Sleep(100 * time.Millisecond)
+		}
+		reader.ReadString('\n')
+	}()
+	return listener.Addr().String()
+}
+
+func testScanner() *Scanner {
+	scanner := &Scanner{}
+	scanner.RegisterFlags(flag.NewFlagSet("test", flag.ContinueOnError))
+	return scanner
+}
+
+func TestLogin(t *testing.T) {
+	tests := []struct {
+		name    string
+		replies []string
+		ok      bool
+	}{
+		{"shell", []string{"\r\n$ "}, true},
+		{"last failed login in the banner", []string{"Last failed login: Mon Oct 5 from 10.0.0.1\r\nuser@host:~$ "}, true},
+		{"warning banner before the prompt", []string{"access denied to unauthorized users\r\n", "router# "}, true},
+		{"login incorrect", []string{"\r\nLogin incorrect\r\n\r\nlogin: "}, false},
+		{"cisco", []string{"\r\n% Login invalid\r\n\r\nUsername: "}, false},
+		{"failure with no prompt", []string{"\r\nAuthentication failed.\r\n"}, false},
+		{"asked to log in again", []string{"\r\nlogin: "}, false},
+	}
+
+	for _, test := range tests {
+		host := fakeDevice(t, test.replies...)
+		s, err := testScanner().connect(host, "user", "pass")
+		if s != nil {
+			s.Close()
+		}
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+		if s != nil && s.banner != "Welcome" {
+			t.Errorf("%s: got banner %q", test.name, s.banner)
+		}
+	}
+}
@@ -1,5 +1,10 @@
 package scanners
 
+import (
+	"flag"
+	"time"
+)
+
 // Hold infromation on all of our
 type Credential struct {
 	Type     string // The type of authentication we have
@@ -21,11 +26,24 @@ type Scanner interface {
 	Scan(target, exec string, cred Credential, out chan Result)
 }
 
+// Scanners that need extra settings from the user can also implement this interface
+// and it will be called before we parse the command line.  Flags should be prefixed
+// with the scanner name so they don't collide (-mysql-tls, not -tls).
+type Configurable interface {
+	// Add any flags this scanner uses to the set
+	RegisterFlags(flags *flag.FlagSet)
+}
+
+// How long a single attempt gets, from -timeout.  Scanners that wait on the other end
+// themselves should give up by then.  Zero means no limit.
+var Timeout time.Duration
+
 // A struct to hold our results before we output them
 type Result struct {
-	Host    string     //The string used to connect to the host
-	Auth    Credential //What we used to authenticate to the target
-	Message string     //The output message received
-	Output  string     //The output of the command run, if any
-	Status  bool       //Whether we were successful or failed
+	Host    string            //The string used to connect to the host
+	Auth    Credential        //What we used to authenticate to the target
+	Message string            //The output message received
+	Output  string            //The output of the command run, if any
+	Status  bool              //Whether we were successful or failed
+	Info    map[string]string //Any extra details we gathered about the target, like a server version
 }
@@ -2,7 +2,6 @@ package vnc
 
 import (
 	"context"
-	"net"
 	"strings"
 
 	"github.com/emperorcow/go-netscan/scanners"
@@ -60,7 +59,16 @@ func (this Scanner) Scan(target, cmd string, cred scanners.Credential, outChan c
 		pass = cred.AuthData
 	}
 
-	nc, err := net.Dial("tcp", target)
+	// If we can't even connect there's nothing to log in to
+	nc, err := scanners.Dial("tcp", target)
+	if err != nil {
+		result.Message = err.Error()
+		result.Status = false
+		outChan <- result
+		return
+	}
+	defer nc.Close()
+
 	// Negotiate connection with the vnc server
 	vcc := vnc.NewClientConfig(pass)
 	_, err = vnc.Connect(context.Background(), nc, vcc)
@@ -0,0 +1,24 @@
+package vnc
+
+import (
+	"net"
+	"testing"
+
+	"github.com/emperorcow/go-netscan/scanners"
+)
+
+func TestScanRefused(t *testing.T) {
+	// Grab a port and let it go again so nothing is listening on it
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := listener.Addr().String()
+	listener.Close()
+
+	out := make(chan scanners.Result, 1)
+	(&Scanner{}).Scan(target, "", scanners.Credential{Type: "basic", AuthData: "password"}, out)
+	if result := <-out; result.Status || result.Message == "" {
+		t.Errorf("got %q %v for a refused connection", result.Message, result.Status)
+	}
+}
@@ -0,0 +1,160 @@
+package winrm
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/Azure/go-ntlmssp"
+	"github.com/emperorcow/go-netscan/scanners"
+	"github.com/masterzen/winrm"
+	"github.com/masterzen/winrm/soap"
+)
+
+// A winrm transport that logs in with NTLM using an NT hash instead of a password.
+// The winrm library only knows about passwords, so this does the NTLM handshake
+// itself on every request, the same way the library's own NTLM transport does.
+type hashTransport struct {
+	domain    string
+	user      string
+	hash      string
+	url       string
+	transport *http.Transport
+}
+
+// Sets up our HTTP transport for the endpoint we'll be talking to
+func (this *hashTransport) Transport(endpoint *winrm.Endpoint) error {
+	this.url, this.transport = newHTTPTransport(endpoint)
+	return nil
+}
+
+// Posts a message to the winrm service, logging in with the hash first
+func (this *hashTransport) Post(client *winrm.Client, request *soap.SoapMessage) (string, error) {
+	httpClient := &http.Client{Transport: this.transport}
+
+	// Start with the negotiate message, the server should answer with its challenge
+	negotiate, err := ntlmssp.NewNegotiateMessage(this.domain, "")
+	if err != nil {
+		return "", err
+	}
+	resp, err := this.send(httpClient, "", negotiate)
+	if err != nil {
+		return "", err
+	}
+	challenge, err := this.challenge(resp)
+	if err != nil {
+		return "", err
+	}
+
+	// Answer the challenge using the hash and send the real message along with it
+	if this.domain != "" {
+		if challenge, err = challengeForDomain(challenge, this.domain); err != nil {
+			return "", err
+		}
+	}
+	authenticate, err := ntlmssp.ProcessChallengeWithHash(challenge, this.user, this.hash)
+	if err != nil {
+		return "", err
+	}
+	resp, err = this.send(httpClient, request.String(), authenticate)
+	if err != nil {
+		return "", err
+	}
+	return readResponse(resp)
+}
+
+// Sends a message to the service with an NTLM token in the authorization header
+func (this *hashTransport) send(httpClient *http.Client, body string, token []byte) (*http.Response, error) {
+	req, err := http.NewRequest("POST", this.url, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/soap+xml;charset=UTF-8")
+	req.Header.Set("Authorization", "Negotiate "+base64.StdEncoding.EncodeToString(token))
+	return httpClient.Do(req)
+}
+
+// Pulls the NTLM challenge out of the server's 401.  We have to read the body so the
+// connection gets reused, since NTLM is tied to the connection it started on.
+func (this *hashTransport) challenge(resp *http.Response) ([]byte, error) {
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		return nil, fmt.Errorf("http error %d: expected an NTLM challenge", resp.StatusCode)
+	}
+	for _, header := range resp.Header.Values("WWW-Authenticate") {
+		fields := strings.Fields(header)
+		if len(fields) == 2 && (fields[0] == "Negotiate" || fields[0] == "NTLM") {
+			return base64.StdEncoding.DecodeString(fields[1])
+		}
+	}
+	return nil, errors.New("Server doesn't support NTLM authentication")
+}
+
+// The NTLM library logs in to whatever domain the server names in its challenge, both
+// in the response it works out and the domain it sends back.  To log in to the domain
+// the user gave us we point the challenge's target name at that domain instead, which
+// is only used for those two things.
+func challengeForDomain(challenge []byte, domain string) ([]byte, error) {
+	if len(challenge) < 24 || !bytes.Equal(challenge[:8], []byte("NTLMSSP\x00")) || binary.LittleEndian.Uint32(challenge[8:]) != 2 {
+		return nil, errors.New("Invalid NTLM challenge")
+	}
+
+	// The name goes in UTF-16 if the server said it speaks unicode
+	name := []byte(domain)
+	if binary.LittleEndian.Uint32(challenge[20:])&0x00000001 != 0 {
+		chars := utf16.Encode([]rune(domain))
+		name = make([]byte, len(chars)*2)
+		for i, c := range chars {
+			binary.LittleEndian.PutUint16(name[i*2:], c)
+		}
+	}
+
+	// Put it on the end so nothing else in the message moves, and point the field at it
+	rewritten := append(append([]byte{}, challenge...), name...)
+	binary.LittleEndian.PutUint16(rewritten[12:], uint16(len(name)))
+	binary.LittleEndian.PutUint16(rewritten[14:], uint16(len(name)))
+	binary.LittleEndian.PutUint32(rewritten[16:], uint32(len(challenge)))
+	return rewritten, nil
+}
+
+// Works out the URL for an endpoint and sets up an HTTP transport with its TLS
+// settings.  Used by the transports we have to write ourselves.
+func newHTTPTransport(endpoint *winrm.Endpoint) (string, *http.Transport) {
+	scheme := "http"
+	if endpoint.HTTPS {
+		scheme = "https"
+	}
+	url := fmt.Sprintf("%s://%s:%d/wsman", scheme, endpoint.Host, endpoint.Port)
+
+	transport := &http.Transport{
+		DialContext:           scanners.DialContext,
+		TLSClientConfig:       &tls.Config{InsecureSkipVerify: endpoint.Insecure},
+		ResponseHeaderTimeout: endpoint.Timeout,
+	}
+	return url, transport
+}
+
+// Reads the body of a response, returning an error the same way the winrm library
+// does if it wasn't a 200.
+func readResponse(resp *http.Response) (string, error) {
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("http error %d: %s", resp.StatusCode, string(body))
+	}
+	return string(body), nil
+}
@@ -0,0 +1,105 @@
+package winrm
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/Azure/go-ntlmssp"
+)
+
+func unicode(s string) []byte {
+	chars := utf16.Encode([]rune(s))
+	b := make([]byte, len(chars)*2)
+	for i, c := range chars {
+		binary.LittleEndian.PutUint16(b[i*2:], c)
+	}
+	return b
+}
+
+// Builds a challenge from a server in the SERVERDOM domain
+func testChallenge(serverChallenge []byte) []byte {
+	targetName := unicode("SERVERDOM")
+	timestamp := make([]byte, 8)
+	binary.LittleEndian.PutUint64(timestamp, 133000000000000000)
+	targetInfo := bytes.Join([][]byte{
+		{2, 0, byte(len(targetName)), 0}, targetName,
+		{7, 0, 8, 0}, timestamp,
+		{0, 0, 0, 0},
+	}, nil)
+
+	msg := make([]byte, 48)
+	copy(msg, "NTLMSSP\x00")
+	binary.LittleEndian.PutUint32(msg[8:], 2)
+	binary.LittleEndian.PutUint16(msg[12:], uint16(len(targetName)))
+	binary.LittleEndian.PutUint16(msg[14:], uint16(len(targetName)))
+	binary.LittleEndian.PutUint32(msg[16:], 48)
+	binary.LittleEndian.PutUint32(msg[20:], 0x00000001|0x00000200|0x00080000|0x00800000) // Unicode, NTLM, ESS, target info
+	copy(msg[24:], serverChallenge)
+	binary.LittleEndian.PutUint16(msg[40:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint16(msg[42:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint32(msg[44:], uint32(48+len(targetName)))
+	return append(append(msg, targetName...), targetInfo...)
+}
+
+// Reads a length/offset field out of an NTLM message
+func field(msg []byte, at int) []byte {
+	length := int(binary.LittleEndian.Uint16(msg[at:]))
+	offset := int(binary.LittleEndian.Uint32(msg[at+4:]))
+	return msg[offset : offset+length]
+}
+
+func TestChallengeForDomain(t *testing.T) {
+	serverChallenge := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	ntHash := "8846f7eaee8fb117ad06bdd830b7586c"
+
+	challenge, err := challengeForDomain(testChallenge(serverChallenge), "corp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticate, err := ntlmssp.ProcessChallengeWithHash(challenge, "alice", ntHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The authenticate message has to name the user's domain, not the server's
+	if domain := field(authenticate, 28); !bytes.Equal(domain, unicode("corp")) {
+		t.Errorf("got domain %q, want corp", domain)
+	}
+	if user := field(authenticate, 36); !bytes.Equal(user, unicode("alice")) {
+		t.Errorf("got user %q, want alice", user)
+	}
+
+	// And the NTLMv2 proof has to be keyed with it too
+	key, _ := hex.DecodeString(ntHash)
+	mac := hmac.New(md5.New, key)
+	mac.Write(unicode("ALICEcorp"))
+	ntowf := mac.Sum(nil)
+
+	ntResponse := field(authenticate, 20)
+	mac = hmac.New(md5.New, ntowf)
+	mac.Write(serverChallenge)
+	mac.Write(ntResponse[16:])
+	if !bytes.Equal(mac.Sum(nil), ntResponse[:16]) {
+		t.Error("NTLMv2 response wasn't worked out for the user's domain")
+	}
+
+	// The target info the server sent has to go back untouched
+	if !bytes.Contains(ntResponse, field(testChallenge(serverChallenge), 40)) {
+		t.Error("target info was changed")
+	}
+}
+
+func TestChallengeForDomainInvalid(t *testing.T) {
+	if _, err := challengeForDomain([]byte("NTLMSSP\x00"), "corp"); err == nil {
+		t.Error("short challenge was accepted")
+	}
+	negotiate, _ := ntlmssp.NewNegotiateMessage("corp", "")
+	if _, err := challengeForDomain(negotiate, "corp"); err == nil {
+		t.Error("negotiate message was accepted as a challenge")
+	}
+}
@@ -0,0 +1,92 @@
+package winrm
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/emperorcow/go-netscan/scanners"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/masterzen/winrm"
+	"github.com/masterzen/winrm/soap"
+)
+
+// A winrm transport that logs in with a kerberos ticket.  The winrm library we use
+// doesn't know about kerberos, so we get the ticket ourselves and put it on each
+// request with SPNEGO.
+type kerberosTransport struct {
+	krb       *client.Client
+	spn       string
+	url       string
+	transport *http.Transport
+}
+
+// Logs in to the KDC for the user and sets up a transport for the host.  Users can be
+// USER@REALM or DOMAIN\USER, and the realm is always upper case.  If we don't have a
+// KDC we'll look up the realm's KDCs in DNS.
+func newKerberosTransport(user, pass, host, kdc string) (*kerberosTransport, error) {
+	// The Kerberos library talks to the KDC itself and has no way for us to hand it a
+	// dialer, so rather than quietly going around a proxy or jump host we don't try
+	if !scanners.DialsDirect() {
+		return nil, errors.New("Kerberos auth can't be used with -proxy, -jump or -source, the library connects to the KDC itself")
+	}
+
+	var realm string
+	if i := strings.LastIndex(user, "@"); i >= 0 {
+		user, realm = user[:i], user[i+1:]
+	} else if strings.Contains(user, "\\") {
+		logonInfo := strings.Split(user, "\\")
+		realm, user = logonInfo[0], logonInfo[1]
+	}
+	realm = strings.ToUpper(realm)
+
+	cfg := config.New()
+	cfg.LibDefaults.DefaultRealm = realm
+	cfg.LibDefaults.UDPPreferenceLimit = 1
+	if kdc != "" {
+		if !strings.Contains(kdc, ":") {
+			kdc = kdc + ":88"
+		}
+		cfg.Realms = append(cfg.Realms, config.Realm{Realm: realm, KDC: []string{kdc}})
+	} else {
+		cfg.LibDefaults.DNSLookupKDC = true
+	}
+
+	krb := client.NewWithPassword(user, realm, pass, cfg, client.DisablePAFXFAST(true))
+	if err := krb.Login(); err != nil {
+		return nil, err
+	}
+
+	return &kerberosTransport{
+		krb: krb,
+		spn: "HTTP/" + host,
+	}, nil
+}
+
+// Sets up our HTTP transport for the endpoint we'll be talking to
+func (this *kerberosTransport) Transport(endpoint *winrm.Endpoint) error {
+	this.url, this.transport = newHTTPTransport(endpoint)
+	return nil
+}
+
+// Posts a message to the winrm service with a service ticket for the host
+func (this *kerberosTransport) Post(client *winrm.Client, request *soap.SoapMessage) (string, error) {
+	httpClient := &http.Client{Transport: this.transport}
+
+	req, err := http.NewRequest("POST", this.url, strings.NewReader(request.String()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/soap+xml;charset=UTF-8")
+	if err := spnego.SetSPNEGOHeader(this.krb, req, this.spn); err != nil {
+		return "", err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	return readResponse(resp)
+}
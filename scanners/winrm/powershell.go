@@ -0,0 +1,181 @@
+package winrm
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// The longest command line cmd.exe will run
+const maxCommandLine = 8191
+
+// PowerShell writes its error, warning and other streams to stderr as CLIXML when it's
+// not talking to a console, and every block starts with this line.
+const clixmlHeader = "#< CLIXML"
+
+// And this is where each block's document ends
+const clixmlFooter = "</Objs>"
+
+// PowerShell escapes characters XML can't hold, like newlines, as _xHHHH_
+var clixmlEscape = regexp.MustCompile(`_x([0-9A-Fa-f]{4})_`)
+
+// What we put in front of each stream's lines so the user can tell them apart, errors
+// are left as they are since that's most of what we'll see.
+var clixmlStreams = map[string]string{
+	"Error":   "",
+	"Warning": "WARNING: ",
+	"Verbose": "VERBOSE: ",
+	"Debug":   "DEBUG: ",
+}
+
+// A file with a PowerShell script in it, read in when the flag is set so every scan
+// uses the same copy.
+type scriptFlag struct {
+	path   string
+	script string
+}
+
+// Returns the file name so the help output can show it
+func (this *scriptFlag) String() string {
+	return this.path
+}
+
+// Reads the script in from the file we were given
+func (this *scriptFlag) Set(path string) error {
+	script, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	this.path = path
+	this.script = string(script)
+	return nil
+}
+
+// Wraps a script in a powershell.exe command line.  The script is sent as an encoded
+// command (base64 of UTF-16LE) so multi-line scripts and quotes make it through the
+// command line untouched.  We turn off the progress stream first, otherwise cmdlets
+// like Invoke-WebRequest fill stderr with progress records.  The encoding makes the
+// script about 2.7 times longer, so we have to check it still fits on a cmd.exe
+// command line.
+func powershellCommand(script string) (string, error) {
+	script = "$ProgressPreference = 'SilentlyContinue'\r\n" + script
+
+	chars := utf16.Encode([]rune(script))
+	wide := make([]byte, len(chars)*2)
+	for i, char := range chars {
+		binary.LittleEndian.PutUint16(wide[i*2:], char)
+	}
+
+	command := "powershell.exe -NoLogo -NonInteractive -NoProfile -ExecutionPolicy Bypass -EncodedCommand " +
+		base64.StdEncoding.EncodeToString(wide)
+	if len(command) > maxCommandLine {
+		return "", fmt.Errorf("Script is too long, it comes to %d characters once encoded and cmd.exe takes at most %d", len(command), maxCommandLine)
+	}
+	return command, nil
+}
+
+// Takes what PowerShell wrote to stderr and turns any CLIXML in it back into plain
+// text, one line per message.  Anything that isn't CLIXML comes back as it was.
+func decodeCLIXML(stderr string) string {
+	if !strings.Contains(stderr, clixmlHeader) {
+		return stderr
+	}
+
+	lines := []string{}
+	for _, block := range strings.Split(stderr, clixmlHeader) {
+		block = strings.TrimSpace(block)
+		if block == "" {
+			continue
+		}
+		if !strings.HasPrefix(block, "<") {
+			// Something else wrote to stderr in between, keep it
+			lines = append(lines, block)
+			continue
+		}
+
+		// Something else can also write after the document and before the next one
+		var rest string
+		if end := strings.Index(block, clixmlFooter); end >= 0 {
+			end += len(clixmlFooter)
+			block, rest = block[:end], strings.TrimSpace(block[end:])
+		}
+		lines = append(lines, clixmlMessages(block)...)
+		if rest != "" {
+			lines = append(lines, rest)
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Pulls the stream messages out of a single CLIXML document.  Each one is an <S>
+// element right under <Objs>, anything else (like progress records) we skip.
+func clixmlMessages(document string) []string {
+	decoder := xml.NewDecoder(strings.NewReader(document))
+
+	var message strings.Builder
+	var prefix string
+	messages := []string{}
+	depth := 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+
+		switch element := token.(type) {
+		case xml.StartElement:
+			depth++
+			if depth != 2 || element.Name.Local != "S" {
+				continue
+			}
+
+			var stream struct {
+				Name string `xml:"S,attr"`
+				Text string `xml:",chardata"`
+			}
+			if err := decoder.DecodeElement(&stream, &element); err != nil {
+				return messages
+			}
+			depth--
+
+			streamPrefix, ok := clixmlStreams[stream.Name]
+			if !ok {
+				continue
+			}
+			if message.Len() == 0 {
+				prefix = streamPrefix
+			}
+
+			// A message can be split over several elements, it's done when it ends
+			// with a newline
+			message.WriteString(clixmlUnescape(stream.Text))
+			text := message.String()
+			if strings.HasSuffix(text, "\n") {
+				messages = append(messages, prefix+strings.TrimRight(text, "\r\n"))
+				message.Reset()
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+
+	if message.Len() > 0 {
+		messages = append(messages, prefix+message.String())
+	}
+	return messages
+}
+
+// Turns the _xHHHH_ escapes PowerShell uses back into the characters they stand for
+func clixmlUnescape(text string) string {
+	return clixmlEscape.ReplaceAllStringFunc(text, func(escape string) string {
+		char, _ := strconv.ParseUint(escape[2:6], 16, 16)
+		return string(rune(char))
+	})
+}
@@ -0,0 +1,90 @@
+package winrm
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// What PowerShell sends when a cmdlet fails, with a progress record first like it
+// sends when it loads modules
+const clixmlError = `#< CLIXML
+<Objs Version="1.1.0.1" xmlns="http://schemas.microsoft.com/powershell/2004/04"><Obj S="progress" RefId="0"><TN RefId="0"><T>System.Management.Automation.PSCustomObject</T><T>System.Object</T></TN><MS><I64 N="SourceId">1</I64><PR N="Record"><AV>Preparing modules for first use.</AV><AI>0</AI><Nil /><PI>-1</PI><PC>-1</PC><T>Completed</T><SR>-1</SR><SD> </SD></PR><S N="Activity">Loading</S></MS></Obj><S S="Error">Get-Item : Cannot find path 'C:\nope' because it does not exist._x000D__x000A_</S><S S="Error">At line:1 char:1_x000D__x000A_</S><S S="Warning">Be careful_x000D__x000A_</S></Objs>`
+
+func TestDecodeCLIXML(t *testing.T) {
+	tests := []struct {
+		name   string
+		stderr string
+		want   string
+	}{
+		{"error", clixmlError,
+			"Get-Item : Cannot find path 'C:\\nope' because it does not exist.\nAt line:1 char:1\nWARNING: Be careful"},
+		{"plain text", "The system cannot find the path specified.\r\n", "The system cannot find the path specified.\r\n"},
+		{"split message",
+			`#< CLIXML` + "\r\n" + `<Objs Version="1.1.0.1" xmlns="http://schemas.microsoft.com/powershell/2004/04"><S S="Error">first half, </S><S S="Error">second half_x000A_</S><S S="Verbose">no newline</S></Objs>`,
+			"first half, second half\nVERBOSE: no newline"},
+		{"escapes",
+			`#< CLIXML` + "\r\n" + `<Objs Version="1.1.0.1" xmlns="http://schemas.microsoft.com/powershell/2004/04"><S S="Debug">a_x0009_b &lt;c&gt;_x000D__x000A_</S><S S="Information">skipped_x000A_</S></Objs>`,
+			"DEBUG: a\tb <c>"},
+		{"text between blocks",
+			clixmlError + "\r\nsomething else\r\n" + clixmlError,
+			"Get-Item : Cannot find path 'C:\\nope' because it does not exist.\nAt line:1 char:1\nWARNING: Be careful\nsomething else\n" +
+				"Get-Item : Cannot find path 'C:\\nope' because it does not exist.\nAt line:1 char:1\nWARNING: Be careful"},
+		{"broken xml", `#< CLIXML` + "\r\n" + `<Objs><S S="Error">cut off_x000A_</S><S S="Error">`, "cut off"},
+	}
+
+	for _, test := range tests {
+		if got := decodeCLIXML(test.stderr); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPowershellCommand(t *testing.T) {
+	script := "Write-Output \"it's\"\r\nGet-Date"
+	cmd, err := powershellCommand(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prefix := "powershell.exe -NoLogo -NonInteractive -NoProfile -ExecutionPolicy Bypass -EncodedCommand "
+	if !strings.HasPrefix(cmd, prefix) {
+		t.Fatalf("got %q", cmd)
+	}
+	wide, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(cmd, prefix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chars := make([]uint16, len(wide)/2)
+	for i := range chars {
+		chars[i] = binary.LittleEndian.Uint16(wide[i*2:])
+	}
+	if got := string(utf16.Decode(chars)); got != "$ProgressPreference = 'SilentlyContinue'\r\n"+script {
+		t.Errorf("got script %q", got)
+	}
+
+	// A script that fits as it is can still be too long once it's encoded
+	if _, err := powershellCommand(strings.Repeat("x", 4000)); err == nil {
+		t.Error("a script past the cmd.exe limit was accepted")
+	}
+}
+
+func TestScriptFlag(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "script.ps1")
+	os.WriteFile(path, []byte("Get-Process"), 0600)
+
+	var script scriptFlag
+	if err := script.Set(path); err != nil {
+		t.Fatal(err)
+	}
+	if script.script != "Get-Process" || script.String() != path {
+		t.Errorf("got %q from %q", script.script, script.String())
+	}
+	if err := script.Set(filepath.Join(t.TempDir(), "missing.ps1")); err == nil {
+		t.Error("missing file was accepted")
+	}
+}
@@ -2,6 +2,8 @@ package winrm
 
 import (
 	"bytes"
+	"errors"
+	"flag"
 	"io"
 	"strconv"
 	"strings"
@@ -11,7 +13,13 @@ import (
 	"github.com/masterzen/winrm"
 )
 
-type Scanner struct{}
+type Scanner struct {
+	https    bool   // Whether we should connect over HTTPS
+	insecure bool   // Whether we should skip checking the server's certificate
+	kdc      string // The KDC to use for kerberos, looked up in DNS if empty
+	shell    string // What we run commands with, cmd or powershell
+	script   scriptFlag
+}
 
 // Returns the name of this scanner
 func (this Scanner) Name() string {
@@ -25,22 +33,38 @@ func (this Scanner) Description() string {
 
 // Return the types of auth we support in  this scanner
 func (this Scanner) SupportedAuthentication() []string {
-	return []string{"basic"}
+	return []string{"basic", "ntlm", "ntlmhash", "kerberos"}
 }
 
 // Returns some examples of how to configure the auth info
 func (this Scanner) SupportedAuthenticationExample() map[string]string {
 	return map[string]string{
-		"basic": "USERNAME,PASSWORD",
+		"basic":    "USERNAME,PASSWORD",
+		"ntlm":     "DOMAIN\\USERNAME,PASSWORD",
+		"kerberos": "USERNAME@REALM,PASSWORD or DOMAIN\\USERNAME,PASSWORD (target must be a host name, not an IP)",
+		"ntlmhash": "DOMAIN\\USERNAME,LMHASH:NTHASH (pass-the-hash over NTLM, the LM hash can be left empty)",
 	}
 }
 
+// Adds our flags to the command line
+func (this *Scanner) RegisterFlags(flags *flag.FlagSet) {
+	flags.BoolVar(&this.https, "winrm-https", false, "Connect to WinRM over HTTPS, port 5986 unless the target has one.")
+	flags.BoolVar(&this.insecure, "winrm-insecure", false, "Don't verify the certificate of WinRM HTTPS servers.")
+	flags.StringVar(&this.kdc, "winrm-kdc", "", "KDC (host:port) for WinRM kerberos auth, looked up in DNS for the realm if empty.")
+	flags.StringVar(&this.shell, "winrm-shell", "cmd", "Shell to run WinRM commands with (cmd, powershell).")
+	flags.Var(&this.script, "winrm-script", "File with a PowerShell script to run over WinRM instead of -c, needs -winrm-shell powershell.")
+}
+
 // Runs the actual scan, takes an input of our target, the creds we need to use for this one,
 // a command to run if we have one, and our out channel for results
 func (this Scanner) Scan(target, exec string, cred scanners.Credential, out chan scanners.Result) {
-	// Add port if the user dosn't provide. Default for basic auth winrm is 5985
+	// Add port if the user dosn't provide. Default for winrm is 5985, or 5986 over HTTPS
 	if !strings.Contains(target, ":") {
-		target = target + ":5985"
+		if this.https {
+			target = target + ":5986"
+		} else {
+			target = target + ":5985"
+		}
 	}
 
 	// Vars to hold our Scanner connection and any erros
@@ -51,6 +75,12 @@ func (this Scanner) Scan(target, exec string, cred scanners.Credential, out chan
 	switch cred.Type {
 	case "basic":
 		client, err = this.basicConnect(cred.Account, target, cred.AuthData)
+	case "ntlm":
+		client, err = this.ntlmConnect(cred.Account, target, cred.AuthData)
+	case "ntlmhash":
+		client, err = this.hashConnect(cred.Account, target, cred.AuthData)
+	case "kerberos":
+		client, err = this.kerberosConnect(cred.Account, target, cred.AuthData)
 	}
 
 	// Let's assume we connect succesfully
@@ -60,24 +90,46 @@ func (this Scanner) Scan(target, exec string, cred scanners.Credential, out chan
 		Message: "Succesfully connected",
 		Status:  true,
 		Output:  "",
+		Info:    map[string]string{},
+	}
+
+	// If we couldn't even build the client (like a bad hash or a kerberos login that
+	// didn't work), there's nothing to connect with
+	if err != nil {
+		result.Message = this.classifyError(err)
+		result.Status = false
+		out <- result
+		return
 	}
 
 	// Create a shell on the object, making a connection to the system
 	shell, err := client.CreateShell()
 	if err != nil {
-		result.Message = err.Error()
+		result.Message = this.classifyError(err)
 		result.Status = false
 	} else {
 		defer shell.Close() // We'll be good and close our connection when done
 	}
 
+	// A script from a file takes the place of -c
+	if this.script.script != "" {
+		exec = this.script.script
+	}
+
 	// if we didn't get an error and we have a command ot run, let's do it.
 	if err == nil && exec != "" {
 		// Execute the command
-		result.Output, err = this.executeCommand(exec, shell)
+		var stderr string
+		var exitCode int
+		result.Output, stderr, exitCode, err = this.executeCommand(exec, shell)
 		if err != nil {
 			// If we got an error let's let the user know
 			result.Output = "Script Error: " + err.Error()
+		} else {
+			result.Info["exit_code"] = strconv.Itoa(exitCode)
+			if stderr != "" {
+				result.Info["stderr"] = strings.Replace(stderr, "\n", "<br>", -1)
+			}
 		}
 	}
 
@@ -85,12 +137,29 @@ func (this Scanner) Scan(target, exec string, cred scanners.Credential, out chan
 	out <- result
 }
 
-// Executes a command on a winrm client connection, returns an error if there is one
-func (this Scanner) executeCommand(cmd string, shell *winrm.Shell) (string, error) {
+// Executes a command on a winrm client connection with the shell we were asked to use.
+// Returns its output and exit code, or an error if it couldn't be run.  With cmd the
+// output is stdout and stderr together as they came back, with PowerShell we get
+// stdout and the decoded stderr separately.
+func (this Scanner) executeCommand(cmd string, shell *winrm.Shell) (string, string, int, error) {
+	switch this.shell {
+	case "cmd":
+		if this.script.script != "" {
+			return "", "", 0, errors.New("-winrm-script needs -winrm-shell powershell")
+		}
+	case "powershell":
+		var err error
+		if cmd, err = powershellCommand(cmd); err != nil {
+			return "", "", 0, err
+		}
+	default:
+		return "", "", 0, errors.New("Unknown WinRM shell " + this.shell + ", use cmd or powershell")
+	}
+
 	// Execute our command on the connection we have.
 	command, err := shell.Execute(cmd)
 	if err != nil {
-		return "", err
+		return "", "", 0, err
 	}
 
 	// We need some buffers for STDOUT and STDERR
@@ -113,15 +182,79 @@ func (this Scanner) executeCommand(cmd string, shell *winrm.Shell) (string, erro
 	command.Wait()
 	wg.Wait()
 
-	// Let's get the strings from our buffers and join them
-	output := outWriter.String() + errWriter.String()
+	// cmd hands back everything it wrote together, the way it always has
+	if this.shell == "cmd" {
+		return outWriter.String() + errWriter.String(), "", command.ExitCode(), nil
+	}
+
+	// Let's get the strings from our buffers, PowerShell's stderr needs to be turned
+	// back into text first
+	stdout := strings.TrimRight(strings.Replace(outWriter.String(), "\r\n", "\n", -1), "\n")
+	stderr := strings.Replace(errWriter.String(), "\r\n", "\n", -1)
+	stderr = strings.TrimRight(decodeCLIXML(stderr), "\n")
 
 	// Finally we can close up and return
-	return output, err
+	return stdout, stderr, command.ExitCode(), nil
 }
 
 // This function builds out a WinRM Client struct for us to then use to actually connect later.
 func (this Scanner) basicConnect(user, host, pass string) (*winrm.Client, error) {
+	// Build our auth to the object, does not connect yet.
+	params := *winrm.DefaultParameters
+	params.Dial = scanners.Dial
+
+	return winrm.NewClientWithParameters(this.endpoint(host), user, pass, &params)
+}
+
+// This function builds out a WinRM Client that logs in over NTLM.  Users can be
+// DOMAIN\USER, otherwise the server's domain is used.
+func (this Scanner) ntlmConnect(user, host, pass string) (*winrm.Client, error) {
+	params := *winrm.DefaultParameters
+	params.TransportDecorator = func() winrm.Transporter { return winrm.NewClientNTLMWithDial(scanners.Dial) }
+
+	return winrm.NewClientWithParameters(this.endpoint(host), user, pass, &params)
+}
+
+// This function builds out a WinRM Client that logs in over NTLM with an NT hash
+// instead of a password.  Users can be DOMAIN\USER, otherwise the server's domain is used.
+func (this Scanner) hashConnect(user, host, authData string) (*winrm.Client, error) {
+	hash, err := scanners.NTHash(authData)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &hashTransport{user: user, hash: hash}
+	if strings.Contains(user, "\\") {
+		logonInfo := strings.Split(user, "\\")
+		transport.domain = logonInfo[0]
+		transport.user = logonInfo[1]
+	}
+
+	// Swap in our transport, the password is never used
+	params := *winrm.DefaultParameters
+	params.TransportDecorator = func() winrm.Transporter { return transport }
+
+	return winrm.NewClientWithParameters(this.endpoint(host), user, "", &params)
+}
+
+// This function logs in to the KDC to get a ticket and builds out a WinRM Client that
+// uses it.  The KDC tells us right away if the password is bad, before we ever talk to
+// the host, and those errors come back here.
+func (this Scanner) kerberosConnect(user, host, pass string) (*winrm.Client, error) {
+	transport, err := newKerberosTransport(user, pass, strings.Split(host, ":")[0], this.kdc)
+	if err != nil {
+		return nil, err
+	}
+
+	// Swap in our transport, the password is only used for the ticket
+	params := *winrm.DefaultParameters
+	params.TransportDecorator = func() winrm.Transporter { return transport }
+
+	return winrm.NewClientWithParameters(this.endpoint(host), user, "", &params)
+}
+
+// Builds the endpoint for a host with our HTTPS settings
+func (this Scanner) endpoint(host string) *winrm.Endpoint {
 	// Split the host into host/ip and port
 	tz := strings.Split(host, ":")
 	// Get our two variables
@@ -129,12 +262,38 @@ func (this Scanner) basicConnect(user, host, pass string) (*winrm.Client, error)
 	// Convert to the port into an integer
 	tzPortInt, _ := strconv.Atoi(tzPort)
 	// Create a new endpoint struct with our port: NewEndpoint(host string, port int, https bool, insecure bool, Cacert, cert, key []byte, timeout time.Duration)
-	endpoint := winrm.NewEndpoint(tzHost, tzPortInt, false, false, nil, nil, nil, 0)
-
-	// Build our auth to the object, does not connect yet.
-	client, err := winrm.NewClient(endpoint, user, pass)
+	return winrm.NewEndpoint(tzHost, tzPortInt, this.https, this.insecure, nil, nil, nil, 0)
+}
 
-	return client, err
+// Takes an error from connecting and turns it into something that tells the user what
+// went wrong.  The winrm library flattens its errors into strings, so that's what we
+// have to look at.
+func (this Scanner) classifyError(err error) string {
+	message := err.Error()
+	switch {
+	case strings.Contains(message, "http error 401") || strings.Contains(message, "error: 401 "):
+		return "Invalid credentials (401 Unauthorized)"
+	case strings.Contains(message, "KDC_ERR_PREAUTH_FAILED"):
+		return "Invalid credentials (kerberos pre-authentication failed)"
+	case strings.Contains(message, "KDC_ERR_C_PRINCIPAL_UNKNOWN"):
+		return "Unknown user (kerberos)"
+	case strings.Contains(message, "KDC_ERR_CLIENT_REVOKED"):
+		return "Account disabled or locked out (kerberos)"
+	case strings.Contains(message, "KDC_ERR_S_PRINCIPAL_UNKNOWN"):
+		return "No kerberos SPN for this host, use its host name instead of an IP"
+	case strings.Contains(message, "x509:"):
+		return "TLS certificate error, use -winrm-insecure to skip checking: " + message
+	case strings.Contains(message, "HTTP response to HTTPS client"):
+		return "TLS error, the server is speaking HTTP, drop -winrm-https or use its HTTPS port"
+	case strings.Contains(message, "malformed HTTP response") || strings.Contains(message, "tls:"):
+		return "TLS error: " + message
+	case strings.Contains(message, "connection refused") || strings.Contains(message, "i/o timeout") ||
+		strings.Contains(message, "no route to host") || strings.Contains(message, "no such host") ||
+		strings.Contains(message, "connection reset"):
+		return "Connection error: " + message
+	default:
+		return message
+	}
 }
 
 // Create a new scanner
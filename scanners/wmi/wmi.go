@@ -1,14 +1,27 @@
 package wmi
 
 import (
+	"encoding/hex"
+	"errors"
 	"math/rand"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/C-Sto/goWMIExec/pkg/wmiexec"
 	"github.com/emperorcow/go-netscan/scanners"
+	"github.com/hirochachacha/go-smb2"
 )
 
+// How long we'll wait for a command to finish and write its output
+const outputWait = 30 * time.Second
+
+// The part of the wmiexec execer we use after logging in
+type execer interface {
+	RPCConnect() error
+	Exec(command string) error
+}
+
 // This is our scanner and does all the work from the main
 type Scanner struct{}
 
@@ -24,13 +37,14 @@ func (this Scanner) Description() string {
 
 // Returns the types of auth we support in this scanner
 func (this Scanner) SupportedAuthentication() []string {
-	return []string{"basic"}
+	return []string{"basic", "ntlmhash"}
 }
 
 // Returns some examples on how to configure the auth info
 func (this Scanner) SupportedAuthenticationExample() map[string]string {
 	return map[string]string{
-		"basic": "USERNAME,PASSWORD,HASH",
+		"basic":    "USERNAME,PASSWORD,HASH (either the password or hash can be left empty)",
+		"ntlmhash": "DOMAIN\\USERNAME,LMHASH:NTHASH (pass-the-hash, the LM hash can be left empty)",
 	}
 }
 
@@ -56,13 +70,6 @@ func (this Scanner) Scan(target, cmd string, cred scanners.Credential, outChan c
 		username = cred.Account
 	}
 
-	// Extract the hash and password from the credentials
-	if strings.Contains(cred.AuthData, ",") {
-		credz := strings.Split(cred.AuthData, ",")
-		userpassword = credz[0]
-		userhash = credz[1]
-	}
-
 	// Let's assume that we connected successfully and declare the data as such, we can edit it later if we failed
 	result := scanners.Result{
 		Host:    target,
@@ -72,40 +79,138 @@ func (this Scanner) Scan(target, cmd string, cred scanners.Credential, outChan c
 		Output:  "",
 	}
 
-	cfg, err := wmiexec.NewExecConfig(username, userpassword, userhash, userdomain, target, RandHostName(), true, nil, nil)
-	if err != nil {
-		result.Output = "Config Error: " + err.Error()
+	// Extract the hash and password from the credentials, either one can be empty
+	switch cred.Type {
+	case "basic":
+		credz := strings.SplitN(cred.AuthData, ",", 2)
+		userpassword = credz[0]
+		if len(credz) > 1 {
+			userhash, err = this.optionalHash(credz[1])
+		}
+	case "ntlmhash":
+		userhash, err = scanners.NTHash(cred.AuthData)
 	}
-	cfgIn := &cfg
 
-	execer := wmiexec.NewExecer(cfgIn)
-	err = execer.Connect()
-	if err != nil {
-		result.Output = "Connect Error: " + err.Error()
+	var exec execer
+	if err == nil {
+		exec, err = this.connect(username, userpassword, userhash, userdomain, target)
 	}
 
-	err = execer.Auth()
+	// If we got an error, let's set the data properly and stop, there's nothing else to do
 	if err != nil {
-		result.Output = "Authentication Error: " + err.Error()
+		result.Message = err.Error()
+		result.Status = false
+		outChan <- result
+		return
 	}
 
+	// If we have a command to run, let's do it.
 	if cmd != "" {
-		err = execer.RPCConnect()
-		if err != nil {
-			result.Output = "RPC Error: " + err.Error()
-		}
-		err = execer.Exec(cmd)
+		// Execute the command
+		result.Output, err = this.executeCommand(exec, cmd, target, username, userpassword, userhash, userdomain)
 		if err != nil {
-			result.Output = "Execution Error: " + err.Error()
+			// If we got an error, let's give the user some output.
+			result.Output = "Command Error: " + err.Error()
 		}
 	}
 
-	result.Output = "Execution Success"
-
 	// Finally, let's pass our result to the proper channel to write out to the user
 	outChan <- result
 }
 
+// Sets up our execer, connects and logs in.  Returns the execer and an error if any
+// of those steps didn't work.
+func (this Scanner) connect(username, password, hash, domain, target string) (execer, error) {
+	// The execer makes its own connections and has no way for us to hand it a dialer,
+	// so rather than quietly going around a proxy or jump host we don't try
+	if !scanners.DialsDirect() {
+		return nil, errors.New("WMI can't be used with -proxy, -jump or -source, the library makes its own connections")
+	}
+
+	cfg, err := wmiexec.NewExecConfig(username, password, hash, domain, target, RandHostName(), true, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := wmiexec.NewExecer(&cfg)
+	if err := client.Connect(); err != nil {
+		return nil, err
+	}
+	if err := client.Auth(); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// WMI only starts a process and doesn't give us its output, so we have the command write
+// its output to a file in the Windows temp directory and then pick it up over ADMIN$.
+// It writes to a temporary name first and renames it when done, so we know it's finished.
+func (this Scanner) executeCommand(exec execer, cmd, target, username, password, hash, domain string) (string, error) {
+	name := `Temp\netscan` + strconv.FormatInt(rand.Int63(), 16)
+	command := `cmd.exe /Q /c (` + cmd + `) > %SYSTEMROOT%\` + name + `.tmp 2>&1 & ` +
+		`move /Y %SYSTEMROOT%\` + name + `.tmp %SYSTEMROOT%\` + name + `.txt`
+
+	if err := exec.RPCConnect(); err != nil {
+		return "", err
+	}
+	if err := exec.Exec(command); err != nil {
+		return "", err
+	}
+
+	// Now log in over SMB with the same credentials to read back the output
+	host := strings.Split(target, ":")[0]
+	conn, err := scanners.Dial("tcp", host+":445")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	initiator := &smb2.NTLMInitiator{User: username, Password: password, Domain: domain}
+	if hash != "" {
+		initiator.Hash, _ = hex.DecodeString(hash)
+	}
+	session, err := (&smb2.Dialer{Initiator: initiator}).Dial(conn)
+	if err != nil {
+		return "", err
+	}
+	defer session.Logoff()
+
+	share, err := session.Mount("ADMIN$")
+	if err != nil {
+		return "", err
+	}
+	defer share.Umount()
+
+	// Wait for the command to finish and the file to show up
+	var output []byte
+	deadline := time.Now().Add(outputWait)
+	for {
+		if output, err = share.ReadFile(name + ".txt"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			share.Remove(name + ".tmp")
+			return "", err
+		}
+		time.Sleep(time.Second)
+	}
+	share.Remove(name + ".txt")
+
+	// Convert our output to a string
+	tmpOut := strings.Replace(string(output), "\r\n", "\n", -1)
+	tmpOut = strings.Replace(strings.TrimRight(tmpOut, "\n"), "\n", "<br>", -1)
+
+	return tmpOut, nil
+}
+
+// Checks the hash part of a basic credential, which is allowed to be empty
+func (this Scanner) optionalHash(hash string) (string, error) {
+	if hash == "" {
+		return "", nil
+	}
+	return scanners.NTHash(hash)
+}
+
 // Creates a new scanner for us to add to the main loop
 func NewScanner() scanners.Scanner {
 	return &Scanner{}
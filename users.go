@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+
+	"github.com/emperorcow/go-netscan/inputs"
+	"github.com/emperorcow/go-netscan/scanners"
+	"github.com/emperorcow/go-netscan/scanners/ldap"
+)
+
+// Gets the list of domain users to try, either from the cache file if we've already
+// pulled them or from the DC.  Users come back as USER@DOMAIN, and anything locked out
+// or within the margin of its lockout threshold is left out.  When we pull them from
+// the DC they're written to the cache file so the next run tries the same accounts.
+func loadDomainUsers(scanner scanners.Scanner, dc, credLine, authType string, margin int, cacheFile string) ([]string, error) {
+	if cacheFile != "" {
+		if users, err := readLines(cacheFile); err == nil {
+			fmt.Printf("Loaded %d users from %s\n", len(users), cacheFile)
+			return users, nil
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	if dc == "" {
+		return nil, fmt.Errorf("no users cached in %s and no -users-dc to pull them from", cacheFile)
+	}
+
+	ldapScanner, cred, err := ldapCredential(scanner, credLine, authType)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := ldapScanner.NewPolicyReader(dc, cred)
+	if err != nil {
+		return nil, err
+	}
+	found, err := reader.Users()
+	if err != nil {
+		return nil, err
+	}
+
+	users := []string{}
+	skipped := 0
+	domain := reader.DomainName()
+	for _, user := range found {
+		if user.Status.Locked || nearThreshold(user.Status, margin) {
+			skipped++
+			continue
+		}
+		users = append(users, user.Name+"@"+domain)
+	}
+	fmt.Printf("Found %d enabled users in %s, skipped %d locked out or close to it\n", len(users), domain, skipped)
+
+	if cacheFile != "" {
+		if err := writeLines(cacheFile, users); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+// Checks if an account is already within the margin of being locked out
+func nearThreshold(status *ldap.AccountStatus, margin int) bool {
+	if status.Policy.Threshold == 0 {
+		return false
+	}
+	return status.RecentBadPasswords() >= status.Policy.Threshold-margin
+}
+
+// Reads a file of passwords, one per line, and adds a credential for every user with
+// each of them.
+func parsePasswords(filePath, authType string, users []string, in inputs.Handler) error {
+	passwords, err := readLines(filePath)
+	if err != nil {
+		return err
+	}
+
+	for _, password := range passwords {
+		for _, user := range users {
+			in.AddCred(scanners.Credential{
+				Type:     authType,
+				Account:  user,
+				AuthData: password,
+			})
+		}
+	}
+	return nil
+}
+
+// Reads a file into a slice, one entry per line.  Blank lines are kept since an
+// empty password is worth trying.
+func readLines(filePath string) ([]string, error) {
+	fileHandle, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer fileHandle.Close()
+
+	lines := []string{}
+	fileScanner := bufio.NewScanner(fileHandle)
+	for fileScanner.Scan() {
+		lines = append(lines, fileScanner.Text())
+	}
+	return lines, fileScanner.Err()
+}
+
+// Writes a slice out to a file, one entry per line
+func writeLines(filePath string, lines []string) error {
+	fileHandle, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer fileHandle.Close()
+
+	writer := bufio.NewWriter(fileHandle)
+	for _, line := range lines {
+		writer.WriteString(line + "\n")
+	}
+	return writer.Flush()
+}
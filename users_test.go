@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emperorcow/go-netscan/inputs"
+	"github.com/emperorcow/go-netscan/scanners"
+	"github.com/emperorcow/go-netscan/scanners/ldap"
+)
+
+// An input handler that just keeps the credentials it's given
+type credList struct {
+	creds []scanners.Credential
+}
+
+func (this *credList) Description() string           { return "test" }
+func (this *credList) Chan() chan inputs.Data        { return nil }
+func (this *credList) AddTarget(target string) error { return nil }
+func (this *credList) Run()                          {}
+func (this *credList) AddCred(cred scanners.Credential) error {
+	this.creds = append(this.creds, cred)
+	return nil
+}
+
+// Writes a file in a temp directory and returns its path
+func tempFile(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParsePasswords(t *testing.T) {
+	passwords := tempFile(t, "Summer2024!\n\nWinter2024!\n")
+	users := []string{"alice@corp.local", "bob@corp.local"}
+
+	in := &credList{}
+	if err := parsePasswords(passwords, "basic", users, in); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every user gets a password before anyone gets the next one, and the blank line
+	// is an empty password
+	want := []scanners.Credential{
+		{Type: "basic", Account: "alice@corp.local", AuthData: "Summer2024!"},
+		{Type: "basic", Account: "bob@corp.local", AuthData: "Summer2024!"},
+		{Type: "basic", Account: "alice@corp.local", AuthData: ""},
+		{Type: "basic", Account: "bob@corp.local", AuthData: ""},
+		{Type: "basic", Account: "alice@corp.local", AuthData: "Winter2024!"},
+		{Type: "basic", Account: "bob@corp.local", AuthData: "Winter2024!"},
+	}
+	if !reflect.DeepEqual(in.creds, want) {
+		t.Errorf("got %v, want %v", in.creds, want)
+	}
+
+	// Commas are part of the password here, not a separator
+	in = &credList{}
+	parsePasswords(tempFile(t, "a,b\n"), "basic", users[:1], in)
+	if len(in.creds) != 1 || in.creds[0].AuthData != "a,b" {
+		t.Errorf("got %v", in.creds)
+	}
+
+	if err := parsePasswords(filepath.Join(t.TempDir(), "missing"), "basic", users, &credList{}); err == nil {
+		t.Error("missing password file was accepted")
+	}
+}
+
+func TestLinesRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.txt")
+	lines := []string{"alice@corp.local", "", "bob@corp.local"}
+	if err := writeLines(path, lines); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readLines(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, lines) {
+		t.Errorf("got %q, want %q", got, lines)
+	}
+}
+
+func TestLoadDomainUsersCache(t *testing.T) {
+	cache := tempFile(t, "alice@corp.local\nbob@corp.local\n")
+
+	// With a cache we never need the DC
+	users, err := loadDomainUsers(nil, "", "", "basic", 1, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(users, []string{"alice@corp.local", "bob@corp.local"}) {
+		t.Errorf("got %q", users)
+	}
+
+	if _, err := loadDomainUsers(nil, "", "", "basic", 1, filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("no cache and no DC was accepted")
+	}
+}
+
+func TestNearThreshold(t *testing.T) {
+	policy := &ldap.LockoutPolicy{Threshold: 5, ObservationWindow: 30 * time.Minute}
+	tests := []struct {
+		name   string
+		status ldap.AccountStatus
+		near   bool
+	}{
+		{"clean", ldap.AccountStatus{Policy: policy}, false},
+		{"below the margin", ldap.AccountStatus{BadPwdCount: 3, BadPasswordTime: time.Now(), Policy: policy}, false},
+		{"at the margin", ldap.AccountStatus{BadPwdCount: 4, BadPasswordTime: time.Now(), Policy: policy}, true},
+		{"old bad passwords", ldap.AccountStatus{BadPwdCount: 4, BadPasswordTime: time.Now().Add(-time.Hour), Policy: policy}, false},
+		{"no lockout", ldap.AccountStatus{BadPwdCount: 100, BadPasswordTime: time.Now(), Policy: &ldap.LockoutPolicy{}}, false},
+	}
+	for _, test := range tests {
+		if got := nearThreshold(&test.status, 1); got != test.near {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.near)
+		}
+	}
+}